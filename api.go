@@ -0,0 +1,399 @@
+package main
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// getAPIUser returns the logged in user of the request if allowed returns true
+// for it, otherwise the error response is written and nil is returned
+func getAPIUser(w http.ResponseWriter, r *http.Request, allowed func(*User) bool) *User {
+	jwtcookie, err := r.Cookie(JWTCOOKIENAME)
+	if err != nil {
+		http.Error(w, "Not logged in", 401)
+		return nil
+	}
+	claims, err := parseJwt(jwtcookie.Value)
+	if err != nil {
+		http.Error(w, "Not logged in", 401)
+		return nil
+	}
+	u, err := db.getUserByUUID(claims.UserId)
+	if err != nil {
+		http.Error(w, "Not logged in", 401)
+		return nil
+	}
+	if !allowed(u) {
+		http.Error(w, "Forbidden", 403)
+		return nil
+	}
+	return u
+}
+
+// allowWrite rejects state changing requests a page on another site could send
+// with the cookie of a logged in user: POST bodies must be json, which forms can
+// not send, and a sent Origin must match the host like for the websocket upgrade
+func allowWrite(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method == "POST" {
+		mediatype, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil || mediatype != "application/json" {
+			http.Error(w, "Unsupported media type", 415)
+			return false
+		}
+	}
+
+	if origin := r.Header.Get("Origin"); origin != "" && !debuggingenabled {
+		u, err := url.Parse(origin)
+		if err != nil || !strings.EqualFold(u.Host, r.Host) {
+			http.Error(w, "Forbidden", 403)
+			return false
+		}
+	}
+	return true
+}
+
+func isAdmin(u *User) bool {
+	return u.featureGet(ISADMIN)
+}
+
+func isModerator(u *User) bool {
+	return u.isModerator()
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, "", 500)
+	}
+}
+
+// GET lists the filters, POST adds one and DELETE removes the one given by ?id=
+func handleAdminFilters(w http.ResponseWriter, r *http.Request) {
+	u := getAPIUser(w, r, isAdmin)
+	if u == nil {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		writeJSON(w, filters.list())
+	case "POST":
+		if !allowWrite(w, r) {
+			return
+		}
+		f := &Filter{}
+		if err := json.NewDecoder(r.Body).Decode(f); err != nil {
+			http.Error(w, "Invalid filter", 400)
+			return
+		}
+		if err := filters.add(u.id, f); err != nil {
+			http.Error(w, "Invalid filter", 400)
+			return
+		}
+		audit(u.id, "ADDFILTER", 0, f.Pattern, f, "")
+		writeJSON(w, f)
+	case "DELETE":
+		if !allowWrite(w, r) {
+			return
+		}
+		id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid id", 400)
+			return
+		}
+		if err := filters.remove(id); err == ErrFilterNotFound {
+			http.Error(w, "Not found", 404)
+			return
+		} else if err != nil {
+			http.Error(w, "", 500)
+			return
+		}
+		audit(u.id, "DELETEFILTER", 0, strconv.FormatInt(id, 10), nil, "")
+		w.WriteHeader(204)
+	default:
+		http.Error(w, "Method not allowed", 405)
+	}
+}
+
+// GET returns the link policy, POST applies a change like the LINKPOLICY command
+func handleAdminLinks(w http.ResponseWriter, r *http.Request) {
+	u := getAPIUser(w, r, isAdmin)
+	if u == nil {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		writeJSON(w, linkpolicy.dump())
+	case "POST":
+		if !allowWrite(w, r) {
+			return
+		}
+		m := &EventDataIn{}
+		if err := json.NewDecoder(r.Body).Decode(m); err != nil {
+			http.Error(w, "Invalid link policy", 400)
+			return
+		}
+		if err := linkpolicy.apply(m.Data, m.Extradata); err != nil {
+			http.Error(w, "Invalid link policy", 400)
+			return
+		}
+		audit(u.id, "LINKPOLICY", 0, m.Extradata, map[string]string{"action": m.Data}, "")
+		writeJSON(w, linkpolicy.dump())
+	default:
+		http.Error(w, "Method not allowed", 405)
+	}
+}
+
+// GET lists the last automod decisions, ?limit= defaults to 100
+func handleAdminAutomod(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	if getAPIUser(w, r, isModerator) == nil {
+		return
+	}
+
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+	writeJSON(w, getAutomodDecisions(limit))
+}
+
+// GET lists the messages waiting for review, oldest first
+func handleAdminHeld(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	if getAPIUser(w, r, isModerator) == nil {
+		return
+	}
+
+	writeJSON(w, held.list())
+}
+
+// GET lists the open reports, POST resolves the one given by ?id=
+func handleAdminReports(w http.ResponseWriter, r *http.Request) {
+	u := getAPIUser(w, r, isModerator)
+	if u == nil {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		reports := []*Report{}
+		db.getOpenReports(func(r *Report) {
+			reports = append(reports, r)
+		})
+		writeJSON(w, reports)
+	case "POST":
+		if !allowWrite(w, r) {
+			return
+		}
+		id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid id", 400)
+			return
+		}
+		ok, err := db.resolveReport(id, u.id)
+		if err != nil {
+			http.Error(w, "", 500)
+			return
+		}
+		if !ok {
+			http.Error(w, "Not found", 404)
+			return
+		}
+		audit(u.id, "RESOLVEREPORT", 0, strconv.FormatInt(id, 10), nil, "")
+		w.WriteHeader(204)
+	default:
+		http.Error(w, "Method not allowed", 405)
+	}
+}
+
+// GET returns the ban of the requesting ip or logged in user, works without
+// logging in because ip bans apply to everyone, 204 if not banned
+func handleMeBan(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+
+	var uid Userid
+	if jwtcookie, err := r.Cookie(JWTCOOKIENAME); err == nil {
+		if claims, err := parseJwt(jwtcookie.Value); err == nil {
+			if u, err := db.getUserByUUID(claims.UserId); err == nil {
+				uid = u.id
+			}
+		}
+	}
+
+	info := bans.getBanInfo(uid, getIPFromWebRequest(r))
+	if info == nil {
+		w.WriteHeader(204)
+		return
+	}
+	writeJSON(w, info)
+}
+
+// GET lists the audit log, newest first, filtered by the ?actor= and ?target=
+// nicks and the ?from= and ?to= unix millisecond timestamps, ?limit= defaults to 100
+func handleAdminAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	if getAPIUser(w, r, isModerator) == nil {
+		return
+	}
+
+	query := r.URL.Query()
+	q := &AuditQuery{}
+	if nick := query.Get("actor"); nick != "" {
+		if q.Userid, _ = db.getUser(nick); q.Userid == 0 {
+			http.Error(w, "Actor not found", 404)
+			return
+		}
+	}
+	if nick := query.Get("target"); nick != "" {
+		if q.Targetuserid, _ = db.getUser(nick); q.Targetuserid == 0 {
+			http.Error(w, "Target not found", 404)
+			return
+		}
+	}
+	q.From, _ = strconv.ParseInt(query.Get("from"), 10, 64)
+	q.To, _ = strconv.ParseInt(query.Get("to"), 10, 64)
+
+	limit, err := strconv.Atoi(query.Get("limit"))
+	if err != nil || limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+	q.Limit = limit
+	writeJSON(w, getAuditLog(q))
+}
+
+// writeModerationError responds with the error identifier of a moderation action
+func writeModerationError(w http.ResponseWriter, err error) {
+	switch err {
+	case errNotFound:
+		http.Error(w, err.Error(), 404)
+	case errNoPermission:
+		http.Error(w, err.Error(), 403)
+	default:
+		http.Error(w, err.Error(), 400)
+	}
+}
+
+// GET lists the active bans, POST bans like the BAN command and DELETE
+// unbans the ?nick= like the UNBAN command
+func handleAdminBans(w http.ResponseWriter, r *http.Request) {
+	u := getAPIUser(w, r, isModerator)
+	if u == nil {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		writeJSON(w, bans.list())
+	case "POST":
+		if !allowWrite(w, r) {
+			return
+		}
+		ban := &BanIn{}
+		if err := json.NewDecoder(r.Body).Decode(ban); err != nil {
+			http.Error(w, "Invalid ban", 400)
+			return
+		}
+		if err := modBan(u, ban); err != nil {
+			writeModerationError(w, err)
+			return
+		}
+		w.WriteHeader(204)
+	case "DELETE":
+		if !allowWrite(w, r) {
+			return
+		}
+		if err := modUnban(u, r.URL.Query().Get("nick")); err != nil {
+			writeModerationError(w, err)
+			return
+		}
+		w.WriteHeader(204)
+	default:
+		http.Error(w, "Method not allowed", 405)
+	}
+}
+
+// GET lists the active mutes, POST mutes like the MUTE command and DELETE
+// unmutes the ?nick= like the UNMUTE command
+func handleAdminMutes(w http.ResponseWriter, r *http.Request) {
+	u := getAPIUser(w, r, isModerator)
+	if u == nil {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		writeJSON(w, mutes.list())
+	case "POST":
+		if !allowWrite(w, r) {
+			return
+		}
+		mute := &EventDataIn{} // Data is the nick
+		if err := json.NewDecoder(r.Body).Decode(mute); err != nil {
+			http.Error(w, "Invalid mute", 400)
+			return
+		}
+		if err := modMute(u, mute.Data, mute.Duration, mute.Reason, mute.Purge); err != nil {
+			writeModerationError(w, err)
+			return
+		}
+		w.WriteHeader(204)
+	case "DELETE":
+		if !allowWrite(w, r) {
+			return
+		}
+		if err := modUnmute(u, r.URL.Query().Get("nick")); err != nil {
+			writeModerationError(w, err)
+			return
+		}
+		w.WriteHeader(204)
+	default:
+		http.Error(w, "Method not allowed", 405)
+	}
+}
+
+// GET returns whether the submode is on, POST turns it on or off like the SUBONLY command
+func handleAdminSubmode(w http.ResponseWriter, r *http.Request) {
+	u := getAPIUser(w, r, isModerator)
+	if u == nil {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		writeJSON(w, map[string]bool{"submode": hub.getSubmode()})
+	case "POST":
+		if !allowWrite(w, r) {
+			return
+		}
+		m := &EventDataIn{} // Data is on/off
+		if err := json.NewDecoder(r.Body).Decode(m); err != nil {
+			http.Error(w, "Invalid submode", 400)
+			return
+		}
+		if err := modSubonly(u, m.Data); err != nil {
+			writeModerationError(w, err)
+			return
+		}
+		w.WriteHeader(204)
+	default:
+		http.Error(w, "Method not allowed", 405)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+)
+
+// AuditEntry is a moderator action, the Userid is 0 for automatic actions
+type AuditEntry struct {
+	Id           int64  `json:"id"`
+	Userid       Userid `json:"userid"`
+	Action       string `json:"action"`
+	Targetuserid Userid `json:"targetuserid,omitempty"`
+	Target       string `json:"target,omitempty"`     // the nick, message id, filter...
+	Parameters   string `json:"parameters,omitempty"` // json encoded
+	Reason       string `json:"reason,omitempty"`
+	Timestamp    int64  `json:"timestamp"` // unix milliseconds
+}
+
+// AuditQuery filters the audit log, zero values match everything
+type AuditQuery struct {
+	Userid       Userid
+	Targetuserid Userid
+	From         int64
+	To           int64
+	Limit        int
+}
+
+// audit records the action in the audit log, params is encoded as json
+func audit(uid Userid, action string, targetuid Userid, target string, params interface{}, reason string) {
+	e := &AuditEntry{
+		Userid:       uid,
+		Action:       action,
+		Targetuserid: targetuid,
+		Target:       target,
+		Reason:       reason,
+		Timestamp:    unixMilliTime(),
+	}
+	if params != nil {
+		if b, err := json.Marshal(params); err == nil {
+			e.Parameters = string(b)
+		}
+	}
+	db.insertAuditEntry(e)
+}
+
+// audit records an action of the user of the connection
+func (c *Connection) audit(action string, targetuid Userid, target string, params interface{}, reason string) {
+	audit(c.user.id, action, targetuid, target, params, reason)
+}
+
+func getAuditLog(q *AuditQuery) []*AuditEntry {
+	entries := []*AuditEntry{}
+	db.getAuditLog(q, func(e *AuditEntry) {
+		entries = append(entries, e)
+	})
+	return entries
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAuditLog(t *testing.T) {
+	audit(51, "BAN", 52, "banned", map[string]int64{"duration": 60}, "spamming")
+	audit(51, "SUBONLY", 0, "", map[string]string{"data": "on"}, "")
+	audit(53, "MUTE", 52, "banned", nil, "")
+
+	// the inserts are done asynchronously
+	var entries []*AuditEntry
+	for i := 0; i < 100; i++ {
+		entries = getAuditLog(&AuditQuery{Targetuserid: 52, Limit: 10})
+		if len(entries) == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(entries) != 2 || entries[0].Action != "MUTE" || entries[1].Action != "BAN" {
+		t.Fatalf("expected the actions against the target newest first, got %+v", entries)
+	}
+	if entries[1].Parameters != `{"duration":60}` || entries[1].Reason != "spamming" {
+		t.Errorf("expected the parameters and reason to be stored, got %+v", entries[1])
+	}
+
+	entries = getAuditLog(&AuditQuery{Userid: 51, Limit: 10})
+	if len(entries) != 2 {
+		t.Errorf("expected the two actions of the actor, got %+v", entries)
+	}
+
+	entries = getAuditLog(&AuditQuery{From: time.Now().Add(time.Hour).UnixNano() / int64(time.Millisecond), Limit: 10})
+	if len(entries) != 0 {
+		t.Errorf("expected nothing in the future, got %+v", entries)
+	}
+}
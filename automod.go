@@ -0,0 +1,261 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	conf "github.com/msbranco/goconfig"
+)
+
+const (
+	AUTOMODREJECT = "reject"
+	AUTOMODHOLD   = "hold"
+	AUTOMODMUTE   = "mute"
+)
+
+// automod rules, each one compares a measure of the message against the
+// threshold of the role of the author, a threshold of 0 disables the rule
+const (
+	AUTOMODCAPS     = "caps"     // share of uppercase letters
+	AUTOMODREPEAT   = "repeat"   // longest run of one character
+	AUTOMODMENTIONS = "mentions" // number of nicks
+	AUTOMODEMOTES   = "emotes"   // number of emotes
+	AUTOMODLINKS    = "links"    // number of links
+)
+
+// below this many letters the caps rule does not apply, "LOL" is fine
+const AUTOMODCAPSMINLETTERS = 12
+
+var automodRules = []string{AUTOMODCAPS, AUTOMODREPEAT, AUTOMODMENTIONS, AUTOMODEMOTES, AUTOMODLINKS}
+
+type Automod struct {
+	enabled      bool
+	muteduration time.Duration
+	actions      map[string]string
+	thresholds   map[string]map[string]float64 // role -> rule -> threshold
+}
+
+type AutomodDecision struct {
+	Userid    Userid  `json:"userid"`
+	Nick      string  `json:"nick"`
+	Message   string  `json:"message"`
+	Rule      string  `json:"rule"`
+	Score     float64 `json:"score"`
+	Action    string  `json:"action"`
+	Timestamp int64   `json:"timestamp"`
+}
+
+var automod = Automod{
+	enabled:      true,
+	muteduration: DEFAULTMUTEDURATION,
+	actions: map[string]string{
+		AUTOMODCAPS:     AUTOMODREJECT,
+		AUTOMODREPEAT:   AUTOMODREJECT,
+		AUTOMODMENTIONS: AUTOMODMUTE,
+		AUTOMODEMOTES:   AUTOMODREJECT,
+		AUTOMODLINKS:    AUTOMODHOLD,
+	},
+	thresholds: map[string]map[string]float64{
+		"default": {
+			AUTOMODCAPS:     0.8,
+			AUTOMODREPEAT:   20,
+			AUTOMODMENTIONS: 5,
+			AUTOMODEMOTES:   15,
+			AUTOMODLINKS:    3,
+		},
+		"subscriber": {
+			AUTOMODCAPS:     0.9,
+			AUTOMODREPEAT:   30,
+			AUTOMODMENTIONS: 8,
+			AUTOMODEMOTES:   30,
+			AUTOMODLINKS:    5,
+		},
+	},
+}
+
+// addAutomodOptions writes the defaults into a new settings.cfg
+func addAutomodOptions(c *conf.ConfigFile) {
+	c.AddOption("automod", "enabled", "true")
+	c.AddOption("automod", "muteduration", fmt.Sprintf("%d", automod.muteduration))
+	for _, rule := range automodRules {
+		c.AddOption("automod", rule+"action", automod.actions[rule])
+	}
+	for role, thresholds := range automod.thresholds {
+		section := "automod-" + role
+		for _, rule := range automodRules {
+			c.AddOption(section, rule, strconv.FormatFloat(thresholds[rule], 'f', -1, 64))
+		}
+	}
+}
+
+// loadAutomodOptions reads settings.cfg, missing options keep their defaults
+func loadAutomodOptions(c *conf.ConfigFile) {
+	if v, err := c.GetBool("automod", "enabled"); err == nil {
+		automod.enabled = v
+	}
+	if v, err := c.GetInt64("automod", "muteduration"); err == nil {
+		automod.muteduration = time.Duration(v)
+	}
+	for _, rule := range automodRules {
+		switch v, _ := c.GetString("automod", rule+"action"); v {
+		case AUTOMODREJECT, AUTOMODHOLD, AUTOMODMUTE:
+			automod.actions[rule] = v
+		}
+	}
+	for role, thresholds := range automod.thresholds {
+		section := "automod-" + role
+		for _, rule := range automodRules {
+			if v, err := c.GetFloat(section, rule); err == nil {
+				thresholds[rule] = v
+			}
+		}
+	}
+}
+
+// measure returns the value of every rule for the message
+func (a *Automod) measure(msg string, e *Entities) map[string]float64 {
+	text := automodPlainText(msg, e)
+
+	var letters, upper, run, longestrun int
+	var last rune
+	for _, r := range text {
+		if unicode.IsLetter(r) {
+			letters++
+			if unicode.IsUpper(r) {
+				upper++
+			}
+		}
+
+		if r == last && !unicode.IsSpace(r) {
+			run++
+		} else {
+			run = 1
+		}
+		if run > longestrun {
+			longestrun = run
+		}
+		last = r
+	}
+
+	var caps float64
+	if letters >= AUTOMODCAPSMINLETTERS {
+		caps = float64(upper) / float64(letters)
+	}
+
+	return map[string]float64{
+		AUTOMODCAPS:     caps,
+		AUTOMODREPEAT:   float64(longestrun),
+		AUTOMODMENTIONS: float64(len(e.Nicks)),
+		AUTOMODEMOTES:   float64(len(e.Emotes)),
+		AUTOMODLINKS:    float64(len(e.Links)),
+	}
+}
+
+// score returns the rule the message exceeds the most and by how much,
+// a score above 1 means the threshold was exceeded
+func (a *Automod) score(u *User, msg string, e *Entities) (string, float64) {
+	role := "default"
+	if u.isSubscriber() {
+		role = "subscriber"
+	}
+	thresholds := a.thresholds[role]
+
+	values := a.measure(msg, e)
+
+	var rule string
+	var score float64
+	for _, r := range automodRules {
+		t := thresholds[r]
+		if t <= 0 {
+			continue
+		}
+		if s := values[r] / t; s > score {
+			rule, score = r, s
+		}
+	}
+	return rule, score
+}
+
+// check returns false if the message was stopped, the decision is recorded
+// and its action is taken against the author
+func (a *Automod) check(c *Connection, out *EventDataOut) bool {
+	if !a.enabled || c.user.isExempt() {
+		return true
+	}
+
+	msg := out.Data
+	rule, score := a.score(c.user, msg, out.Entities)
+	if score <= 1 {
+		return true
+	}
+
+	action := a.actions[rule]
+	db.insertAutomodDecision(&AutomodDecision{
+		Userid:    c.user.id,
+		Nick:      c.user.nick,
+		Message:   msg,
+		Rule:      rule,
+		Score:     score,
+		Action:    action,
+		Timestamp: unixMilliTime(),
+	})
+
+	switch action {
+	case AUTOMODMUTE:
+		c.autoMute(int64(a.muteduration), "automod: "+rule)
+	case AUTOMODHOLD:
+		held.hold(c, out, "automod: "+rule)
+	default:
+		c.SendError("automod")
+	}
+	return false
+}
+
+// automodPlainText returns the message without emotes, nicks and links, so
+// that emote names like PepoThink do not count as caps
+func automodPlainText(msg string, e *Entities) string {
+	runes := []rune(msg)
+	skip := make([]bool, len(runes))
+	mark := func(start, end int) {
+		for i := start; i < end && i < len(skip); i++ {
+			skip[i] = true
+		}
+	}
+
+	for _, em := range e.Emotes {
+		mark(em.Bounds[0], em.Bounds[1])
+	}
+	for _, n := range e.Nicks {
+		mark(n.Bounds[0], n.Bounds[1])
+	}
+	// link bounds are byte offsets
+	for _, l := range e.Links {
+		if l.Bounds[1] > len(msg) {
+			continue
+		}
+		mark(utf8.RuneCountInString(msg[:l.Bounds[0]]), utf8.RuneCountInString(msg[:l.Bounds[1]]))
+	}
+
+	var b strings.Builder
+	for i, r := range runes {
+		if skip[i] {
+			b.WriteRune(' ')
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// getAutomodDecisions returns the last decisions, newest first
+func getAutomodDecisions(limit int) []*AutomodDecision {
+	out := []*AutomodDecision{}
+	db.getAutomodDecisions(limit, func(d *AutomodDecision) {
+		out = append(out, d)
+	})
+	return out
+}
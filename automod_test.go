@@ -0,0 +1,42 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAutomodScore(t *testing.T) {
+	u := &User{}
+
+	rule, score := automod.score(u, "just a normal message", &Entities{})
+	if score > 1 {
+		t.Error("normal message should not exceed any threshold, got", rule, score)
+	}
+
+	rule, score = automod.score(u, "THIS IS A VERY LOUD MESSAGE", &Entities{})
+	if rule != AUTOMODCAPS || score <= 1 {
+		t.Error("caps message should exceed the caps threshold, got", rule, score)
+	}
+
+	// emote names are not counted as caps
+	msg := "PepoThink PepoThink PepoThink hello there friends"
+	e := &Entities{Emotes: []*Emote{
+		{Name: "PepoThink", Bounds: [2]int{0, 9}},
+		{Name: "PepoThink", Bounds: [2]int{10, 19}},
+		{Name: "PepoThink", Bounds: [2]int{20, 29}},
+	}}
+	if rule, score = automod.score(u, msg, e); score > 1 {
+		t.Error("emotes should not count as caps, got", rule, score)
+	}
+
+	rule, score = automod.score(u, "a"+strings.Repeat("h", 25), &Entities{})
+	if rule != AUTOMODREPEAT || score <= 1 {
+		t.Error("repeated characters should exceed the repeat threshold, got", rule, score)
+	}
+
+	// subscribers get more room
+	u.setFeatures([]string{"subscriber"})
+	if rule, score = automod.score(u, "a"+strings.Repeat("h", 25), &Entities{}); score > 1 {
+		t.Error("subscriber threshold should not be exceeded, got", rule, score)
+	}
+}
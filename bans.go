@@ -2,6 +2,8 @@ package main
 
 import (
 	"database/sql"
+	"net"
+	"strings"
 	"sync"
 	"time"
 )
@@ -10,37 +12,115 @@ type Bans struct {
 	users    map[Userid]time.Time
 	userlock sync.RWMutex
 	ips      map[string]time.Time
-	userips  map[Userid][]string
-	iplock   sync.RWMutex // protects both ips/userips
+	ranges   ipTrie
+	userips  map[Userid][]string // single ips or ranges in cidr notation
+	iplock   sync.RWMutex        // protects ips/ranges/userips
 }
 
-var bans = Bans{make(map[Userid]time.Time), sync.RWMutex{}, make(map[string]time.Time), make(map[Userid][]string), sync.RWMutex{}}
+// BanInfo is what banned users are told about their ban
+type BanInfo struct {
+	Description     string `json:"description"`
+	Reason          string `json:"reason,omitempty"`
+	Expiretimestamp int64  `json:"expiretimestamp,omitempty"` // unix milliseconds
+	Ispermanent     bool   `json:"ispermanent"`
+	IPBan           bool   `json:"ipban"`
+}
 
-func (b *Bans) run() { // TODO in init? probably need to init the structs here from db on start
-	t := time.NewTicker(time.Minute)
-	for range t.C {
-		b.clean()
+func newBanInfo(reason string, expiretime time.Time, ipban bool) *BanInfo {
+	info := &BanInfo{
+		Description: "banned",
+		Reason:      reason,
+		IPBan:       ipban,
+	}
+	if expiretime.Before(getFuturetimeUTC()) {
+		info.Expiretimestamp = expiretime.UnixNano() / int64(time.Millisecond)
+	} else {
+		info.Ispermanent = true
 	}
+	return info
 }
 
-func (b *Bans) clean() { // TODO is this used / necessary???
-	b.userlock.Lock()
-	defer b.userlock.Unlock()
-	b.iplock.Lock()
-	defer b.iplock.Unlock()
+var bans = Bans{
+	users:   make(map[Userid]time.Time),
+	ips:     make(map[string]time.Time),
+	userips: make(map[Userid][]string),
+}
 
-	for uid, unbantime := range b.users {
-		if isExpiredUTC(unbantime) {
-			delete(b.users, uid)
-			b.userips[uid] = nil
-		}
+// parseRange returns the network if the ip ban key is a range in cidr notation
+func parseRange(key string) *net.IPNet {
+	if !strings.Contains(key, "/") {
+		return nil
+	}
+	_, n, err := net.ParseCIDR(key)
+	if err != nil {
+		return nil
+	}
+	return n
+}
+
+// ipBanKey returns the range to ban for the ip if the ban has a prefix length
+// for its address family, the ip itself otherwise
+func ipBanKey(ip string, ban *BanIn) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ip
 	}
 
-	for ip, unbantime := range b.ips {
-		if isExpiredUTC(unbantime) {
-			delete(b.ips, ip)
+	var mask net.IPMask
+	if v4 := parsed.To4(); v4 != nil {
+		if ban.IPv4Prefix == 0 {
+			return ip
+		}
+		parsed = v4
+		mask = net.CIDRMask(ban.IPv4Prefix, 8*net.IPv4len)
+	} else {
+		if ban.IPv6Prefix == 0 {
+			return ip
 		}
+		mask = net.CIDRMask(ban.IPv6Prefix, 8*net.IPv6len)
+	}
+	n := &net.IPNet{IP: parsed.Mask(mask), Mask: mask}
+	return n.String()
+}
+
+// getIPBan expects the iplock to be held
+func (b *Bans) getIPBan(key string) (time.Time, bool) {
+	if n := parseRange(key); n != nil {
+		return b.ranges.get(n)
+	}
+	t, ok := b.ips[key]
+	return t, ok
+}
+
+// setIPBan expects the iplock to be held
+func (b *Bans) setIPBan(key string, t time.Time) {
+	if n := parseRange(key); n != nil {
+		b.ranges.insert(n, t)
+		return
+	}
+	b.ips[key] = t
+}
+
+// deleteIPBan expects the iplock to be held
+func (b *Bans) deleteIPBan(key string) {
+	if n := parseRange(key); n != nil {
+		b.ranges.remove(n)
+		return
 	}
+	delete(b.ips, key)
+}
+
+// findIPBan returns the key of the ban covering the ip, either the ip itself
+// or the range it is in, expects the iplock to be held
+func (b *Bans) findIPBan(ip string) (string, time.Time, bool) {
+	if t, ok := b.ips[ip]; isStillBanned(t, ok) {
+		return ip, t, true
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return "", time.Time{}, false
+	}
+	return b.ranges.lookup(parsed)
 }
 
 func (b *Bans) banUser(uid Userid, targetuid Userid, ban *BanIn) {
@@ -55,38 +135,64 @@ func (b *Bans) banUser(uid Userid, targetuid Userid, ban *BanIn) {
 	b.userlock.Lock()
 	b.users[targetuid] = expiretime
 	b.userlock.Unlock()
+	expirations.schedule(EXPIREBAN, targetuid, expiretime)
 	b.log(uid, targetuid, ban, "")
+	info := newBanInfo(ban.Reason, expiretime, false)
 
 	if ban.BanIP {
-		// ips := getIPCacheForUser(targetuid) //TODO
-		// if len(ips) == 0 {
-		ips := hub.getIPsForUserid(targetuid)
+		ips := getIPsForUserid(targetuid)
 		if len(ips) == 0 {
-			D("No ips found for user (offline)", targetuid)
+			D("No ips found for user", targetuid)
 		}
-		//}
 
 		b.iplock.Lock()
 		defer b.iplock.Unlock()
+		banned := make(map[string]bool, len(ips))
 		for _, ip := range ips {
-			b.banIP(targetuid, ip, expiretime, true)
-			hub.ipbans <- ip
-			b.log(uid, targetuid, ban, ip)
-			D("IPBanned user", ban.Nick, targetuid, "with ip:", ip)
+			key := ipBanKey(ip, ban)
+			if banned[key] {
+				continue
+			}
+			banned[key] = true
+			b.banIP(targetuid, key, expiretime, true)
+			hub.ipbans <- &ipBan{key, newBanInfo(ban.Reason, expiretime, true)}
+			b.log(uid, targetuid, ban, key)
+			D("IPBanned user", ban.Nick, targetuid, "with ip:", key)
 		}
 	}
 
-	hub.bans <- targetuid
+	hub.bans <- &userBan{targetuid, info}
 	D("Banned user", ban.Nick, targetuid)
 }
 
+// getIPsForUserid returns the ips the user logged in from and the ones of
+// its live connections, so that offline users can be ip banned too
+func getIPsForUserid(uid Userid) []string {
+	ips, err := db.getUserIPs(uid, time.Now().UTC().Add(-IPBANHISTORY))
+	if err != nil {
+		D("Unable to get the ips of", uid, err)
+	}
+
+	seen := make(map[string]bool, len(ips))
+	for _, ip := range ips {
+		seen[ip] = true
+	}
+	for _, ip := range hub.getIPsForUserid(uid) {
+		if !seen[ip] {
+			seen[ip] = true
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
 func (b *Bans) banIP(uid Userid, ip string, t time.Time, skiplock bool) {
 	if !skiplock { // because the caller holds the locks
 		b.iplock.Lock()
 		defer b.iplock.Unlock()
 	}
 
-	b.ips[ip] = t
+	b.setIPBan(ip, t)
 	if _, ok := b.userips[uid]; !ok {
 		b.userips[uid] = make([]string, 0, 1)
 	}
@@ -102,13 +208,81 @@ func (b *Bans) unbanUserid(uid Userid) {
 
 	delete(b.users, uid)
 	for _, ip := range b.userips[uid] {
-		delete(b.ips, ip)
+		b.deleteIPBan(ip)
 		D("Unbanned IP: ", ip, "for uid:", uid)
 	}
 	b.userips[uid] = nil
 	D("Unbanned uid: ", uid)
 }
 
+// expireUserid removes the ban of the user and its ips if the ban still ends
+// at the given time, returns false if it was lifted or changed since
+func (b *Bans) expireUserid(uid Userid, at time.Time) bool {
+	b.userlock.Lock()
+	defer b.userlock.Unlock()
+	b.iplock.Lock()
+	defer b.iplock.Unlock()
+
+	expired := false
+	if t, ok := b.users[uid]; ok && t.Equal(at) {
+		delete(b.users, uid)
+		expired = true
+	}
+
+	ips := b.userips[uid][:0]
+	for _, ip := range b.userips[uid] {
+		if t, ok := b.getIPBan(ip); ok && t.Equal(at) {
+			b.deleteIPBan(ip)
+			D("Expired ban of IP: ", ip, "for uid:", uid)
+			expired = true
+		} else if ok {
+			ips = append(ips, ip)
+		}
+	}
+	b.userips[uid] = ips
+
+	if expired {
+		D("Expired ban of uid: ", uid)
+	}
+	return expired
+}
+
+// BanEntry is an active ban as listed by the admin api
+type BanEntry struct {
+	Userid          Userid `json:"userid"`
+	Nick            string `json:"nick,omitempty"`
+	IP              string `json:"ip,omitempty"`
+	Expiretimestamp int64  `json:"expiretimestamp"` // unix milliseconds
+}
+
+// list returns the active user and ip bans
+func (b *Bans) list() []*BanEntry {
+	entries := []*BanEntry{}
+
+	b.userlock.RLock()
+	for uid, t := range b.users {
+		if !isExpiredUTC(t) {
+			entries = append(entries, &BanEntry{Userid: uid, Expiretimestamp: t.UnixNano() / int64(time.Millisecond)})
+		}
+	}
+	b.userlock.RUnlock()
+
+	b.iplock.RLock()
+	for uid, ips := range b.userips {
+		for _, ip := range ips {
+			if t, ok := b.getIPBan(ip); ok && !isExpiredUTC(t) {
+				entries = append(entries, &BanEntry{Userid: uid, IP: ip, Expiretimestamp: t.UnixNano() / int64(time.Millisecond)})
+			}
+		}
+	}
+	b.iplock.RUnlock()
+
+	for _, e := range entries {
+		e.Nick, _ = db.getNick(e.Userid)
+	}
+	return entries
+}
+
 func isStillBanned(t time.Time, ok bool) bool {
 	if !ok {
 		return false
@@ -129,10 +303,40 @@ func (b *Bans) isUseridBanned(uid Userid) bool {
 func (b *Bans) isIPBanned(ip string) bool {
 	b.iplock.RLock()
 	defer b.iplock.RUnlock()
-	t, ok := b.ips[ip]
-	return isStillBanned(t, ok)
+	_, _, banned := b.findIPBan(ip)
+	return banned
+}
+
+// getBanInfo returns the details of the ban of either the ip or the user,
+// or nil if neither of them is banned
+func (b *Bans) getBanInfo(uid Userid, ip string) *BanInfo {
+	b.iplock.RLock()
+	key, t, ipban := b.findIPBan(ip)
+	b.iplock.RUnlock()
+
+	if !ipban {
+		if uid == 0 {
+			return nil
+		}
+		b.userlock.RLock()
+		ut, ok := b.users[uid]
+		b.userlock.RUnlock()
+		if !isStillBanned(ut, ok) {
+			return nil
+		}
+		t = ut
+	}
+
+	// the ban of the ip is looked up by the ip or range it was stored with
+	reason, err := db.getBanReason(uid, key)
+	if err != nil {
+		D("Unable to get ban reason", uid, ip, err)
+	}
+	return newBanInfo(reason, t, ipban)
 }
 
+// loadActive fills the bans from the database, it runs on startup before the
+// hub does and before anyone is connected, so the hub is not told about them
 func (b *Bans) loadActive() {
 	b.userlock.Lock()
 	defer b.userlock.Unlock()
@@ -142,23 +346,24 @@ func (b *Bans) loadActive() {
 	// purge all the bans
 	b.users = make(map[Userid]time.Time)
 	b.ips = make(map[string]time.Time)
+	b.ranges = ipTrie{}
 	b.userips = make(map[Userid][]string)
 
-	db.getBans(func(uid Userid, ipaddress sql.NullString, endtimestamp time.Time) {
+	db.getBans(func(uid Userid, ipaddress sql.NullString, reason string, endtimestamp time.Time) {
 		if endtimestamp.String() == "" { // TODO check is done before already? clean up...
 			endtimestamp = getFuturetimeUTC()
 		}
 
 		if ipaddress.Valid {
-			b.ips[ipaddress.String] = endtimestamp
+			b.setIPBan(ipaddress.String, endtimestamp)
 			if _, ok := b.userips[uid]; !ok {
 				b.userips[uid] = make([]string, 0, 1)
 			}
 			b.userips[uid] = append(b.userips[uid], ipaddress.String)
-			hub.ipbans <- ipaddress.String
 		} else {
 			b.users[uid] = endtimestamp
 		}
+		expirations.schedule(EXPIREBAN, uid, endtimestamp)
 	})
 }
 
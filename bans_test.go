@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"testing"
 	"time"
 )
@@ -29,11 +30,138 @@ func TestBanTimes(t *testing.T) {
 		t.Error("ip should NOT be banned because the expiretime is in the past")
 	}
 
-	bans.clean()
-	if len(bans.users) > 0 {
-		t.Error("bans.clean did not clean the users")
+	delete(bans.users, uid)
+	delete(bans.ips, ip)
+}
+
+func TestBanInfo(t *testing.T) {
+	timeinfuture := time.Date(time.Now().Year()+1, time.September, 10, 23, 0, 0, 0, time.UTC)
+	uid := Userid(2)
+	ip := "10.1.2.4"
+
+	if info := bans.getBanInfo(uid, ip); info != nil {
+		t.Fatalf("expected no ban info, got %+v", info)
+	}
+
+	bans.users[uid] = timeinfuture
+	info := bans.getBanInfo(uid, ip)
+	if info == nil || info.IPBan || info.Ispermanent || info.Expiretimestamp != timeinfuture.Unix()*1000 {
+		t.Errorf("expected a timed user ban, got %+v", info)
+	}
+
+	bans.ips[ip] = getFuturetimeUTC()
+	info = bans.getBanInfo(uid, ip)
+	if info == nil || !info.IPBan || !info.Ispermanent || info.Expiretimestamp != 0 {
+		t.Errorf("expected a permanent ip ban, got %+v", info)
+	}
+
+	delete(bans.users, uid)
+	delete(bans.ips, ip)
+}
+
+func TestUserIPHistory(t *testing.T) {
+	uid := Userid(3)
+	db.insertUserIP(uid, "10.1.2.5")
+	db.insertUserIP(uid, "10.1.2.6")
+	db.insertUserIP(uid, "10.1.2.5")
+
+	ips, err := db.getUserIPs(uid, time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 2 {
+		t.Errorf("expected every ip once, got %v", ips)
+	}
+
+	db.db.Exec(`UPDATE user_ips SET lastseen = 0 WHERE ipaddress = '10.1.2.6'`)
+	ips, _ = db.getUserIPs(uid, time.Now().Add(-time.Hour))
+	if len(ips) != 1 || ips[0] != "10.1.2.5" {
+		t.Errorf("only the recently used ip should be returned, got %v", ips)
+	}
+}
+
+func TestLoadManyIPBans(t *testing.T) {
+	uid := Userid(5)
+	for i := 0; i < 2*cap(hub.ipbans); i++ {
+		db.db.Exec(`
+			INSERT INTO bans (userid, targetuserid, ipaddress, reason, starttimestamp, endtimestamp)
+			VALUES (1, ?, ?, 'many ips', strftime('%s', 'now'), strftime('%s', 'now') + 3600)
+		`, uid, fmt.Sprintf("10.1.5.%d", i))
+	}
+	defer func() {
+		db.db.Exec(`DELETE FROM bans WHERE targetuserid = ?`, uid)
+		bans.loadActive()
+	}()
+
+	// the hub is not running, loading must not wait for it
+	done := make(chan bool)
+	go func() {
+		bans.loadActive()
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("loading the bans blocked")
+	}
+
+	if !bans.isIPBanned("10.1.5.7") {
+		t.Error("the loaded ip bans should be active")
+	}
+}
+
+func TestRangeBans(t *testing.T) {
+	uid := Userid(4)
+	ban := &BanIn{IPv4Prefix: 24, IPv6Prefix: 48}
+	if key := ipBanKey("10.1.3.7", ban); key != "10.1.3.0/24" {
+		t.Errorf("expected the /24 of the ip, got %s", key)
+	}
+	if key := ipBanKey("2001:db8:1234:5678::", ban); key != "2001:db8:1234::/48" {
+		t.Errorf("expected the /48 of the ip, got %s", key)
+	}
+	if key := ipBanKey("10.1.3.7", &BanIn{}); key != "10.1.3.7" {
+		t.Errorf("expected the ip itself without a prefix, got %s", key)
+	}
+
+	bans.banIP(uid, "10.1.3.0/24", time.Now().UTC().Add(time.Hour), false)
+	if !bans.isIPBanned("10.1.3.200") {
+		t.Error("an ip in the banned range should be banned")
+	}
+	if bans.isIPBanned("10.1.4.1") {
+		t.Error("an ip outside the banned range should not be banned")
+	}
+	if info := bans.getBanInfo(0, "10.1.3.200"); info == nil || !info.IPBan {
+		t.Errorf("expected an ip ban, got %+v", info)
+	}
+	if b := (&ipBan{ip: "10.1.3.0/24"}); !b.matches("10.1.3.9") || b.matches("10.1.2.9") {
+		t.Error("live connections in the range should be matched")
+	}
+
+	bans.unbanUserid(uid)
+	if bans.isIPBanned("10.1.3.200") {
+		t.Error("the range should be unbanned")
+	}
+}
+
+func TestMaskedIP(t *testing.T) {
+	defer func() {
+		IPV4MASK = 32
+		IPV6MASK = 64
+	}()
+
+	if ip := getMaskedIP("2001:db8:1:2:3:4:5:6"); ip != "2001:db8:1:2::" {
+		t.Errorf("expected the /64, got %s", ip)
+	}
+	if ip := getMaskedIP("10.1.2.3"); ip != "10.1.2.3" {
+		t.Errorf("ipv4 should not be masked by default, got %s", ip)
+	}
+
+	IPV4MASK = 24
+	IPV6MASK = 48
+	if ip := getMaskedIP("10.1.2.3"); ip != "10.1.2.0" {
+		t.Errorf("expected the /24, got %s", ip)
 	}
-	if len(bans.ips) > 0 {
-		t.Error("bans.clean did not clean the ips")
+	if ip := getMaskedIP("2001:db8:1:2:3:4:5:6"); ip != "2001:db8:1::" {
+		t.Errorf("expected the /48, got %s", ip)
 	}
 }
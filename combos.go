@@ -4,6 +4,7 @@ import (
 	"errors"
 	"strings"
 	"sync"
+	"unicode"
 )
 
 var ErrComboDuplicate = errors.New("user has already participated in combo")
@@ -88,3 +89,25 @@ func isEmoteMessage(msg *EventDataOut) bool {
 	b := msg.Entities.Emotes[0].Bounds
 	return b[0] == 0 && b[1] == len(msg.Data)
 }
+
+// isEmoteOnlyMessage checks if the message has nothing but emotes and whitespace
+func isEmoteOnlyMessage(msg *EventDataOut) bool {
+	if len(msg.Entities.Emotes) == 0 {
+		return false
+	}
+
+	// emote bounds are rune offsets
+	runes := []rune(msg.Data)
+	for _, e := range msg.Entities.Emotes {
+		for i := e.Bounds[0]; i < e.Bounds[1] && i < len(runes); i++ {
+			runes[i] = ' '
+		}
+	}
+
+	for _, r := range runes {
+		if !unicode.IsSpace(r) {
+			return false
+		}
+	}
+	return true
+}
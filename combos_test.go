@@ -0,0 +1,27 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestIsEmoteOnlyMessage(t *testing.T) {
+	emotes := []*Emote{
+		{Name: "PepoThink", Bounds: [2]int{0, 9}},
+		{Name: "PepoThink", Bounds: [2]int{11, 20}},
+	}
+
+	msg := &EventDataOut{Data: "PepoThink  PepoThink ", Entities: &Entities{Emotes: emotes}}
+	if !isEmoteOnlyMessage(msg) {
+		t.Error("emotes separated by whitespace should be an emote-only message")
+	}
+
+	msg = &EventDataOut{Data: "PepoThink  PepoThink hi", Entities: &Entities{Emotes: emotes}}
+	if isEmoteOnlyMessage(msg) {
+		t.Error("text next to the emotes should not be an emote-only message")
+	}
+
+	msg = &EventDataOut{Data: "   ", Entities: &Entities{}}
+	if isEmoteOnlyMessage(msg) {
+		t.Error("a message without emotes should not be an emote-only message")
+	}
+}
@@ -1,9 +1,8 @@
 package main
 
 import (
-	"bytes"
-	"crypto/md5"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -31,10 +30,13 @@ type Connection struct {
 	send           chan *message
 	sendmarshalled chan *message
 	blocksend      chan *message
-	banned         chan bool
+	banned         chan *BanInfo
+	kicked         chan string
 	stop           chan bool
 	user           *User
 	ping           chan time.Time
+	resumeid       int64
+	replay         chan []*message
 	sync.RWMutex
 }
 
@@ -47,14 +49,19 @@ type EventDataIn struct {
 	Data      string `json:"data"`
 	Extradata string `json:"extradata"`
 	Duration  int64  `json:"duration"`
+	Purge     bool   `json:"purge"`
+	Reason    string `json:"reason"`
 }
 
 type EventDataOut struct {
 	*SimplifiedUser
 	Targetuserid Userid    `json:"-"`
+	Messageid    int64     `json:"messageid,omitempty"`
+	Targetmsgid  int64     `json:"targetmessageid,omitempty"`
 	Timestamp    int64     `json:"timestamp"`
 	Data         string    `json:"data,omitempty"`
 	Extradata    string    `json:"extradata,omitempty"`
+	Duration     int64     `json:"duration,omitempty"`
 	Entities     *Entities `json:"entities,omitempty"`
 }
 
@@ -64,6 +71,33 @@ type BanIn struct {
 	Duration    int64  `json:"duration"`
 	Ispermanent bool   `json:"ispermanent"`
 	Reason      string `json:"reason"`
+	Purge       bool   `json:"purge"`
+	// with banip, ban the whole range of this prefix length instead of the ip
+	IPv4Prefix int `json:"ipv4prefix"`
+	IPv6Prefix int `json:"ipv6prefix"`
+}
+
+type KickIn struct {
+	Nick   string `json:"nick"`
+	Reason string `json:"reason"`
+}
+
+// ErrorOut is an ERR with details, the description is the usual error identifier
+type ErrorOut struct {
+	Description string `json:"description"`
+	Reason      string `json:"reason,omitempty"`
+}
+
+type DeleteIn struct {
+	Messageid int64 `json:"messageid"`
+}
+
+type FilterIn struct {
+	Id       int64  `json:"id"`
+	Pattern  string `json:"pattern"`
+	Regex    bool   `json:"regex"`
+	Action   string `json:"action"`
+	Duration int64  `json:"duration"`
 }
 
 type PingOut struct {
@@ -72,6 +106,10 @@ type PingOut struct {
 
 type message struct {
 	msgtyp int
+	id     int64
+	nick   string // the author of history events
+	target string // the nick whose messages a PURGE removes
+	userid Userid // only the connections of the user get the event when set
 	event  string
 	data   interface{}
 }
@@ -83,7 +121,6 @@ type PrivmsgIn struct {
 
 type PrivmsgOut struct {
 	message
-	targetuid  Userid
 	Messageid  int64     `json:"messageid"`
 	Timestamp  int64     `json:"timestamp"`
 	Nick       string    `json:"nick,omitempty"`
@@ -93,19 +130,24 @@ type PrivmsgOut struct {
 }
 
 // Create a new connection using the specified socket and router.
-func newConnection(s *websocket.Conn, user *User, ip string) {
+func newConnection(s *websocket.Conn, user *User, ip string, resumeid int64) {
 	c := &Connection{
 		socket:         s,
 		ip:             ip,
 		send:           make(chan *message, SENDCHANNELSIZE),
 		sendmarshalled: make(chan *message, SENDCHANNELSIZE),
 		blocksend:      make(chan *message),
-		banned:         make(chan bool, 8),
+		banned:         make(chan *BanInfo, 8),
+		kicked:         make(chan string, 8),
 		stop:           make(chan bool),
 		user:           user,
 		ping:           make(chan time.Time, 2),
+		resumeid:       resumeid,
 		RWMutex:        sync.RWMutex{},
 	}
+	if resumeid > 0 {
+		c.replay = make(chan []*message, 1)
+	}
 
 	go c.writePumpText()
 	c.readPumpText()
@@ -176,8 +218,20 @@ func (c *Connection) readPumpText() {
 			c.OnBan(data)
 		case "UNBAN":
 			c.OnUnban(data)
+		case "KICK":
+			c.OnKick(data)
+		case "DELETE":
+			c.OnDelete(data)
+		case "CLEAR":
+			c.OnClear(data)
 		case "SUBONLY":
 			c.OnSubonly(data)
+		case "SLOWMODE":
+			c.OnSlowmode(data)
+		case "EMOTEONLY":
+			c.OnEmoteonly(data)
+		case "ACCOUNTAGE":
+			c.OnAccountage(data)
 		case "PING":
 			c.OnPing(data)
 		case "PONG":
@@ -186,6 +240,22 @@ func (c *Connection) readPumpText() {
 			c.OnBroadcast(data)
 		case "PRIVMSG":
 			c.OnPrivmsg(data)
+		case "ADDFILTER":
+			c.OnAddFilter(data)
+		case "DELETEFILTER":
+			c.OnDeleteFilter(data)
+		case "LINKPOLICY":
+			c.OnLinkPolicy(data)
+		case "APPROVE":
+			c.OnApprove(data)
+		case "DENY":
+			c.OnDeny(data)
+		case "REPORT":
+			c.OnReport(data)
+		case "SHADOWBAN":
+			c.OnShadowban(data)
+		case "UNSHADOWBAN":
+			c.OnUnshadowban(data)
 		}
 	}
 }
@@ -201,6 +271,12 @@ func (c *Connection) writePumpText() {
 		c.socket.Close() // Necessary to force reading to stop, will start the cleanup
 	}()
 
+	// when resuming, live events wait in the channel until the missed ones are written
+	sendmarshalled := c.sendmarshalled
+	if c.replay != nil {
+		sendmarshalled = nil
+	}
+
 	for {
 		select {
 		case _, ok := <-c.ping:
@@ -211,8 +287,16 @@ func (c *Connection) writePumpText() {
 			if err := c.write(websocket.PingMessage, m); err != nil {
 				return
 			}
-		case <-c.banned:
-			c.write(websocket.TextMessage, []byte(`ERR "banned"`))
+		case info := <-c.banned:
+			if data, err := packError(info); err == nil {
+				c.write(websocket.TextMessage, data)
+			}
+			c.write(websocket.CloseMessage, []byte{})
+			return
+		case reason := <-c.kicked:
+			if data, err := packError(&ErrorOut{Description: "kicked", Reason: reason}); err == nil {
+				c.write(websocket.TextMessage, data)
+			}
 			c.write(websocket.CloseMessage, []byte{})
 			return
 		case <-c.stop:
@@ -245,7 +329,16 @@ func (c *Connection) writePumpText() {
 			} else {
 				c.runlockUserIfExists()
 			}
-		case message := <-c.sendmarshalled:
+		case missed := <-c.replay:
+			for _, message := range missed {
+				if data, err := Pack(message.event, message.data.([]byte)); err == nil {
+					if err := c.write(websocket.TextMessage, data); err != nil {
+						return
+					}
+				}
+			}
+			sendmarshalled = c.sendmarshalled
+		case message := <-sendmarshalled:
 			data := message.data.([]byte)
 			if data, err := Pack(message.event, data); err == nil {
 				typ := message.msgtyp
@@ -291,38 +384,34 @@ func (c *Connection) EmitBlock(event string, data interface{}) {
 }
 
 func (c *Connection) Broadcast(event string, data *EventDataOut) {
-	c.rlockUserIfExists()
-	marshalled, _ := Marshal(data)
-	c.runlockUserIfExists()
-
-	m := &message{
-		event: event,
-		data:  marshalled,
-	}
-	hub.broadcast <- m
+	broadcastFrom(c.user, event, data)
 }
 
-func (c *Connection) canModerateUser(nick string) (bool, Userid) {
-	if c.user == nil || utf8.RuneCountInString(nick) == 0 {
-		return false, 0
-	}
+// Echo sends the event to every connection of the user as if it was broadcast,
+// without it reaching anyone else or the history
+func (c *Connection) Echo(event string, data *EventDataOut) {
+	queueEvents(func(id int64) []*message {
+		data.Messageid = id
 
-	uid, protected := usertools.getUseridForNick(nick)
-	if uid == 0 || c.user.id == uid || protected {
-		return false, uid
-	}
+		c.rlockUserIfExists()
+		marshalled, _ := Marshal(data)
+		c.runlockUserIfExists()
 
-	return true, uid
+		return []*message{{
+			id:     id,
+			userid: c.user.id,
+			event:  event,
+			data:   marshalled,
+		}}
+	})
+}
+
+func (c *Connection) canModerateUser(nick string) (bool, Userid) {
+	return canModerate(c.user, nick)
 }
 
 func (c *Connection) getEventDataOut() *EventDataOut {
-	out := &EventDataOut{
-		Timestamp: unixMilliTime(),
-	}
-	if c.user != nil {
-		out.SimplifiedUser = c.user.simplified
-	}
-	return out
+	return newEventDataOut(c.user)
 }
 
 func (c *Connection) Join() {
@@ -374,6 +463,7 @@ func (c *Connection) OnBroadcast(data []byte) {
 	out := c.getEventDataOut()
 	out.Data = msg
 	out.Entities = entities.Extract(msg)
+	c.audit("BROADCAST", 0, "", map[string]string{"data": msg}, "")
 	c.Broadcast("BROADCAST", out)
 }
 
@@ -394,6 +484,26 @@ func (c *Connection) canMsg(msg string, ignoresilence bool) bool {
 			c.SendError("submode")
 			return false
 		}
+
+		if hub.isAccountTooYoung(c) {
+			c.SendError("accounttooyoung")
+			return false
+		}
+
+		if slowmode := hub.getSlowmode(); slowmode > 0 && !c.user.isExempt() {
+			if time.Since(c.user.lastchattime) < slowmode {
+				c.SendError("slowmode")
+				return false
+			}
+		}
+	}
+
+	if c.user != nil && !c.user.isModerator() {
+		// held chat messages are handled in OnMsg, once the whole event exists
+		if f := filters.match(msg); f != nil && (f.Action != FILTERHOLD || ignoresilence) {
+			f.apply(c)
+			return false
+		}
 	}
 
 	if c.user != nil && !c.user.isBot() {
@@ -438,33 +548,69 @@ func (c *Connection) OnMsg(data []byte) {
 		return
 	}
 
+	// shadowbanned messages never reach the holding queue, automod or the
+	// spam detection, the user only sees their own message as if it was sent
+	if shadowbans.isShadowbanned(c.user.id) {
+		out := c.getEventDataOut()
+		out.Data = msg
+		out.Entities = entities.Extract(msg)
+		c.user.lastchattime = time.Now()
+		c.Echo("MSG", out)
+		return
+	}
+
 	// strip off /me for anti-spam purposes
-	var bmsg []byte
+	bmsg := msg
 	if len(msg) > 4 && msg[:4] == "/me " {
-		bmsg = []byte(strings.TrimSpace(msg[4:]))
-	} else {
-		bmsg = []byte(msg)
+		bmsg = strings.TrimSpace(msg[4:])
 	}
 
-	tsum := md5.Sum(bmsg)
-	sum := tsum[:]
-	if bytes.Equal(sum, c.user.lastmessage) {
+	if c.user.isDuplicate(bmsg) {
 		c.user.delayscale++
 		c.SendError("duplicate")
 		return
 	}
-	c.user.lastmessage = sum
 
 	out := c.getEventDataOut()
 	out.Data = msg
 	out.Entities = entities.Extract(msg)
 
+	if !linkpolicy.allows(c.user, out.Entities.Links) {
+		c.SendError("linknotallowed")
+		return
+	}
+
+	if hub.mustSendEmotes(c) && !isEmoteOnlyMessage(out) {
+		c.SendError("emoteonly")
+		return
+	}
+
+	if !c.user.isModerator() {
+		if f := filters.match(msg); f != nil && f.Action == FILTERHOLD {
+			held.hold(c, out, "filter: "+f.Pattern)
+			return
+		}
+	}
+
+	if !automod.check(c, out) {
+		return
+	}
+
+	if !spamwaves.check(c, msg, out.Entities) {
+		return
+	}
+
 	if err := combos.Transform(out); err == ErrComboDuplicate {
 		c.SendError("duplicate")
 		return
 	}
 	TransformRares(out)
 
+	// only messages that made it through start the slowmode cooldown and count
+	// for the duplicate check, a corrected retry of a rejected one is fine
+	c.user.lastchattime = time.Now()
+	c.user.addMessage(bmsg)
+
 	c.Broadcast("MSG", out)
 }
 
@@ -491,28 +637,47 @@ func (c *Connection) OnPrivmsg(data []byte) {
 		return
 	}
 
+	ents := entities.Extract(msg)
+	if !linkpolicy.allows(c.user, ents.Links) {
+		c.SendError("linknotallowed")
+		return
+	}
+
 	// ephemeral private messages
 	// in particular, messages sent to users that are offline will never be delivered
 	// TODO search db instead? -> can tell user that name is right, but just offline.
 
-	pout := &PrivmsgOut{
-		message: message{
-			event: "PRIVMSG",
-		},
-		Nick:       c.user.nick,
-		TargetNick: pin.Nick,
-		targetuid:  Userid(tuid),
-		Data:       msg,
-		Messageid:  1337, // no saving in db means ids do not matter
-		Timestamp:  unixMilliTime(),
-		Entities:   entities.Extract(msg),
-	}
-
-	pout.message.data, _ = Marshal(pout)
-
-	c.Emit("PRIVMSGSENT", pout)
-
-	hub.privmsg <- pout
+	// the private messages of shadowbanned users are never delivered either
+	shadowbanned := shadowbans.isShadowbanned(c.user.id)
+
+	queueEvents(func(id int64) []*message {
+		pout := &PrivmsgOut{
+			message: message{
+				id:     id,
+				userid: Userid(tuid),
+				event:  "PRIVMSG",
+			},
+			Nick:       c.user.nick,
+			TargetNick: pin.Nick,
+			Data:       msg,
+			Messageid:  id,
+			Timestamp:  unixMilliTime(),
+			Entities:   ents,
+		}
+		pout.message.data, _ = Marshal(pout)
+
+		// the sender is told through the hub too, so it gets the ids in order
+		sent := &message{
+			id:     id,
+			userid: c.user.id,
+			event:  "PRIVMSGSENT",
+			data:   pout.message.data,
+		}
+		if shadowbanned {
+			return []*message{sent}
+		}
+		return []*message{sent, &pout.message}
+	})
 }
 
 func (c *Connection) Names() {
@@ -538,32 +703,86 @@ func (c *Connection) OnMute(data []byte) {
 		return
 	}
 
-	ok, uid := c.canModerateUser(mute.Data)
+	if err := modMute(c.user, mute.Data, mute.Duration, mute.Reason, mute.Purge); err != nil {
+		c.SendError(err.Error())
+	}
+}
+
+func (c *Connection) OnUnmute(data []byte) {
+	user := &EventDataIn{} // Data is the nick
+	if err := Unmarshal(data, user); err != nil {
+		c.SendError("protocolerror")
+		return
+	}
 
-	if !ok || uid == 0 {
+	if c.user == nil || !c.user.isModerator() {
 		c.SendError("nopermission")
 		return
 	}
 
-	if mute.Duration == 0 {
-		mute.Duration = int64(DEFAULTMUTEDURATION)
+	if err := modUnmute(c.user, user.Data); err != nil {
+		c.SendError(err.Error())
+	}
+}
+
+func (c *Connection) Muted() {
+}
+
+// autoMute mutes the user of the connection without a moderator, for automatic
+// actions like filters
+func (c *Connection) autoMute(duration int64, reason string) {
+	mutes.muteUserid(0, c.user.id, duration, reason)
+	audit(0, "MUTE", c.user.id, c.user.nick, map[string]int64{"duration": duration}, reason)
+	broadcastFrom(nil, "MUTE", &EventDataOut{
+		Targetuserid: c.user.id,
+		Timestamp:    unixMilliTime(),
+		Data:         c.user.nick,
+	})
+	c.SendError("muted")
+}
+
+func (c *Connection) OnBan(data []byte) {
+	ban := &BanIn{}
+	if err := Unmarshal(data, ban); err != nil {
+		c.SendError("protocolerror")
+		return
+	}
+
+	if c.user == nil {
+		c.SendError("nopermission")
+		return
 	}
 
-	if time.Duration(mute.Duration) > 7*24*time.Hour {
-		c.SendError("protocolerror") // too long mute
+	if !c.user.isModerator() {
+		c.SendError("nopermission")
 		return
 	}
 
-	mutes.muteUserid(uid, mute.Duration)
-	out := c.getEventDataOut()
-	out.Data = mute.Data
-	out.Targetuserid = uid
-	c.Broadcast("MUTE", out)
+	if err := modBan(c.user, ban); err != nil {
+		c.SendError(err.Error())
+	}
 }
 
-func (c *Connection) OnUnmute(data []byte) {
-	user := &EventDataIn{} // Data is the nick
-	if err := Unmarshal(data, user); err != nil || utf8.RuneCountInString(user.Data) == 0 {
+func (c *Connection) OnUnban(data []byte) {
+	user := &EventDataIn{}
+	if err := Unmarshal(data, user); err != nil {
+		c.SendError("protocolerror")
+		return
+	}
+
+	if c.user == nil || !c.user.isModerator() {
+		c.SendError("nopermission")
+		return
+	}
+
+	if err := modUnban(c.user, user.Data); err != nil {
+		c.SendError(err.Error())
+	}
+}
+
+func (c *Connection) OnKick(data []byte) {
+	kick := &KickIn{}
+	if err := Unmarshal(data, kick); err != nil {
 		c.SendError("protocolerror")
 		return
 	}
@@ -573,67 +792,114 @@ func (c *Connection) OnUnmute(data []byte) {
 		return
 	}
 
-	uid, _ := usertools.getUseridForNick(user.Data)
+	ok, uid := c.canModerateUser(kick.Nick)
 	if uid == 0 {
 		c.SendError("notfound")
 		return
+	} else if !ok {
+		c.SendError("nopermission")
+		return
+	}
+
+	reason := strings.TrimSpace(kick.Reason)
+	if !utf8.ValidString(reason) {
+		c.SendError("invalidmsg")
+		return
 	}
 
-	mutes.unmuteUserid(uid)
+	hub.kicks <- &kickUser{userid: uid, reason: reason}
+	c.audit("KICK", uid, kick.Nick, nil, reason)
 	out := c.getEventDataOut()
-	out.Data = user.Data
+	out.Data = kick.Nick
+	out.Extradata = reason
 	out.Targetuserid = uid
-	c.Broadcast("UNMUTE", out)
-}
-
-func (c *Connection) Muted() {
+	c.Broadcast("KICK", out)
 }
 
-func (c *Connection) OnBan(data []byte) {
-	ban := &BanIn{}
-	if err := Unmarshal(data, ban); err != nil {
+func (c *Connection) OnDelete(data []byte) {
+	d := &DeleteIn{}
+	if err := Unmarshal(data, d); err != nil || d.Messageid <= 0 {
 		c.SendError("protocolerror")
 		return
 	}
 
-	if c.user == nil {
+	if c.user == nil || !c.user.isModerator() {
 		c.SendError("nopermission")
 		return
 	}
 
-	if !c.user.isModerator() {
-		c.SendError("nopermission")
+	// the messages table holds the same events as the cache, so anything not
+	// cached can not be shown to anyone anymore
+	e := getCachedEvent(d.Messageid)
+
+	// only chat messages can be deleted, not broadcasts or moderation events
+	if e == nil || e.event != "MSG" {
+		c.SendError("notfound")
 		return
 	}
 
-	ok, uid := c.canModerateUser(ban.Nick)
-	if uid == 0 {
-		c.SendError("notfound")
+	nick := e.nick
+	ok, uid := c.canModerateUser(nick)
+	if !ok {
+		c.SendError("nopermission")
 		return
-	} else if !ok {
+	}
+
+	deleteChatEvent(d.Messageid)
+	c.audit("DELETE", uid, nick, map[string]int64{"messageid": d.Messageid}, "")
+	out := c.getEventDataOut()
+	out.Data = nick
+	out.Targetmsgid = d.Messageid
+	c.Broadcast("DELETE", out)
+}
+
+func (c *Connection) OnClear(data []byte) {
+	if c.user == nil || !c.user.isModerator() {
 		c.SendError("nopermission")
 		return
 	}
 
-	reason := strings.TrimSpace(ban.Reason)
-	if utf8.RuneCountInString(reason) == 0 || !utf8.ValidString(reason) {
-		c.SendError("needbanreason")
+	// the hub wipes the history when it gets the event, the CLEAR itself
+	// stays in the history as the record of who cleared the chat
+	D("Chat cleared by", c.user.nick, c.user.id)
+	c.audit("CLEAR", 0, "", nil, "")
+	c.Broadcast("CLEAR", c.getEventDataOut())
+}
+
+func (c *Connection) OnShadowban(data []byte) {
+	user := &EventDataIn{} // Data is the nick
+	if err := Unmarshal(data, user); err != nil {
+		c.SendError("protocolerror")
+		return
+	}
+
+	if c.user == nil || !c.user.isModerator() {
+		c.SendError("nopermission")
 		return
 	}
 
-	if ban.Duration == 0 {
-		ban.Duration = int64(DEFAULTBANDURATION)
+	ok, uid := c.canModerateUser(user.Data)
+	if uid == 0 {
+		c.SendError("notfound")
+		return
+	} else if !ok {
+		c.SendError("nopermission")
+		return
 	}
 
-	bans.banUser(c.user.id, uid, ban)
+	shadowbans.shadowbanUser(c.user.id, uid)
+	c.audit("SHADOWBAN", uid, user.Data, nil, "")
 	out := c.getEventDataOut()
-	out.Data = ban.Nick
+	out.Data = user.Data
 	out.Targetuserid = uid
-	c.Broadcast("BAN", out)
+	// only moderators may know, or the user would just make a new account
+	c.rlockUserIfExists()
+	hub.emitToModerators("SHADOWBAN", out)
+	c.runlockUserIfExists()
 }
 
-func (c *Connection) OnUnban(data []byte) {
-	user := &EventDataIn{}
+func (c *Connection) OnUnshadowban(data []byte) {
+	user := &EventDataIn{} // Data is the nick
 	if err := Unmarshal(data, user); err != nil {
 		c.SendError("protocolerror")
 		return
@@ -644,22 +910,31 @@ func (c *Connection) OnUnban(data []byte) {
 		return
 	}
 
-	uid, _ := usertools.getUseridForNick(user.Data)
+	ok, uid := c.canModerateUser(user.Data)
 	if uid == 0 {
 		c.SendError("notfound")
 		return
+	} else if !ok {
+		c.SendError("nopermission")
+		return
 	}
 
-	bans.unbanUserid(uid)
-	mutes.unmuteUserid(uid)
+	shadowbans.unshadowbanUser(uid)
+	c.audit("UNSHADOWBAN", uid, user.Data, nil, "")
 	out := c.getEventDataOut()
 	out.Data = user.Data
 	out.Targetuserid = uid
-	c.Broadcast("UNBAN", out)
+	c.rlockUserIfExists()
+	hub.emitToModerators("UNSHADOWBAN", out)
+	c.runlockUserIfExists()
+}
+
+func (c *Connection) Banned(info *BanInfo) {
+	c.banned <- info
 }
 
-func (c *Connection) Banned() {
-	c.banned <- true
+func (c *Connection) Kicked(reason string) {
+	c.kicked <- reason
 }
 
 func (c *Connection) OnSubonly(data []byte) {
@@ -674,19 +949,215 @@ func (c *Connection) OnSubonly(data []byte) {
 		return
 	}
 
+	if err := modSubonly(c.user, m.Data); err != nil {
+		c.SendError(err.Error())
+	}
+}
+
+func (c *Connection) OnEmoteonly(data []byte) {
+	m := &EventDataIn{} // Data is on/off
+	if err := Unmarshal(data, m); err != nil {
+		c.SendError("protocolerror")
+		return
+	}
+
+	if c.user == nil || !c.user.isModerator() {
+		c.SendError("nopermission")
+		return
+	}
+
 	switch {
 	case m.Data == "on":
-		hub.toggleSubmode(true)
+		hub.toggleEmoteonly(true)
 	case m.Data == "off":
-		hub.toggleSubmode(false)
+		hub.toggleEmoteonly(false)
 	default:
 		c.SendError("protocolerror")
 		return
 	}
 
+	c.audit("EMOTEONLY", 0, "", map[string]string{"data": m.Data}, "")
 	out := c.getEventDataOut()
 	out.Data = m.Data
-	c.Broadcast("SUBONLY", out)
+	c.Broadcast("EMOTEONLY", out)
+}
+
+func (c *Connection) OnSlowmode(data []byte) {
+	m := &EventDataIn{} // Duration is the time between messages, 0 turns it off
+	if err := Unmarshal(data, m); err != nil {
+		c.SendError("protocolerror")
+		return
+	}
+
+	if c.user == nil || !c.user.isModerator() {
+		c.SendError("nopermission")
+		return
+	}
+
+	d := time.Duration(m.Duration)
+	if d < 0 || d > MAXSLOWMODEDURATION {
+		c.SendError("protocolerror")
+		return
+	}
+
+	hub.setSlowmode(d)
+	c.audit("SLOWMODE", 0, "", map[string]int64{"duration": m.Duration}, "")
+
+	out := c.getEventDataOut()
+	out.Data = "off"
+	if d > 0 {
+		out.Data = "on"
+	}
+	out.Duration = m.Duration
+	c.Broadcast("SLOWMODE", out)
+}
+
+func (c *Connection) OnAccountage(data []byte) {
+	m := &EventDataIn{} // Duration is the minimum account age, 0 turns it off
+	if err := Unmarshal(data, m); err != nil {
+		c.SendError("protocolerror")
+		return
+	}
+
+	if c.user == nil || !c.user.isModerator() {
+		c.SendError("nopermission")
+		return
+	}
+
+	d := time.Duration(m.Duration)
+	if d < 0 || d > MAXACCOUNTAGE {
+		c.SendError("protocolerror")
+		return
+	}
+
+	hub.setMinAccountAge(d)
+	c.audit("ACCOUNTAGE", 0, "", map[string]int64{"duration": m.Duration}, "")
+
+	out := c.getEventDataOut()
+	out.Data = "off"
+	if d > 0 {
+		out.Data = "on"
+	}
+	out.Duration = m.Duration
+	c.Broadcast("ACCOUNTAGE", out)
+}
+
+func (c *Connection) OnAddFilter(data []byte) {
+	in := &FilterIn{}
+	if err := Unmarshal(data, in); err != nil {
+		c.SendError("protocolerror")
+		return
+	}
+
+	if c.user == nil || !c.user.featureGet(ISADMIN) {
+		c.SendError("nopermission")
+		return
+	}
+
+	f := &Filter{
+		Pattern:  in.Pattern,
+		Regex:    in.Regex,
+		Action:   in.Action,
+		Duration: in.Duration,
+	}
+	if err := filters.add(c.user.id, f); err != nil {
+		c.SendError("invalidfilter")
+		return
+	}
+	c.audit("ADDFILTER", 0, f.Pattern, f, "")
+
+	c.Emit("FILTERS", filters.list())
+}
+
+func (c *Connection) OnDeleteFilter(data []byte) {
+	in := &FilterIn{}
+	if err := Unmarshal(data, in); err != nil {
+		c.SendError("protocolerror")
+		return
+	}
+
+	if c.user == nil || !c.user.featureGet(ISADMIN) {
+		c.SendError("nopermission")
+		return
+	}
+
+	if err := filters.remove(in.Id); err == ErrFilterNotFound {
+		c.SendError("notfound")
+		return
+	} else if err != nil {
+		c.SendError("protocolerror")
+		return
+	}
+	c.audit("DELETEFILTER", 0, strconv.FormatInt(in.Id, 10), nil, "")
+
+	c.Emit("FILTERS", filters.list())
+}
+
+func (c *Connection) OnLinkPolicy(data []byte) {
+	m := &EventDataIn{} // Data is the action, Extradata the domain or on/off
+	if err := Unmarshal(data, m); err != nil {
+		c.SendError("protocolerror")
+		return
+	}
+
+	if c.user == nil || !c.user.featureGet(ISADMIN) {
+		c.SendError("nopermission")
+		return
+	}
+
+	if err := linkpolicy.apply(m.Data, m.Extradata); err != nil {
+		c.SendError("protocolerror")
+		return
+	}
+	c.audit("LINKPOLICY", 0, m.Extradata, map[string]string{"action": m.Data}, "")
+
+	c.Emit("LINKPOLICY", linkpolicy.dump())
+}
+
+func (c *Connection) OnApprove(data []byte) {
+	in := &HeldIn{}
+	if err := Unmarshal(data, in); err != nil {
+		c.SendError("protocolerror")
+		return
+	}
+
+	if c.user == nil || !c.user.isModerator() {
+		c.SendError("nopermission")
+		return
+	}
+
+	m := held.take(in.Id)
+	if m == nil {
+		c.SendError("notfound")
+		return
+	}
+
+	c.audit("APPROVE", m.userid, m.Message.Nick, map[string]int64{"heldid": m.Id}, "")
+	// sent as it was written, with the original timestamp
+	broadcastFrom(nil, "MSG", m.Message)
+	hub.emitToModerators("APPROVE", &HeldResolvedOut{m.Id, c.user.nick, unixMilliTime()})
+}
+
+func (c *Connection) OnDeny(data []byte) {
+	in := &HeldIn{}
+	if err := Unmarshal(data, in); err != nil {
+		c.SendError("protocolerror")
+		return
+	}
+
+	if c.user == nil || !c.user.isModerator() {
+		c.SendError("nopermission")
+		return
+	}
+
+	m := held.take(in.Id)
+	if m == nil {
+		c.SendError("notfound")
+		return
+	}
+
+	c.audit("DENY", m.userid, m.Message.Nick, map[string]int64{"heldid": m.Id}, "")
+	hub.emitToModerators("DENY", &HeldResolvedOut{m.Id, c.user.nick, unixMilliTime()})
 }
 
 func (c *Connection) Ping() {
@@ -704,6 +1175,15 @@ func (c *Connection) OnPing(data []byte) {
 func (c *Connection) OnPong(data []byte) {
 }
 
+// packError packs an ERR event with details instead of just the identifier
+func packError(out interface{}) ([]byte, error) {
+	data, err := Marshal(out)
+	if err != nil {
+		return nil, err
+	}
+	return Pack("ERR", data)
+}
+
 func (c *Connection) SendError(identifier string) {
 	c.EmitBlock("ERR", identifier)
 }
@@ -12,9 +12,16 @@ import (
 )
 
 type database struct {
-	db        *sqlx.DB
-	insertban chan *dbInsertBan
-	deleteban chan *dbDeleteBan
+	db            *sqlx.DB
+	insertban     chan *dbInsertBan
+	deleteban     chan *dbDeleteBan
+	insertmute    chan *dbInsertMute
+	deletemute    chan *dbDeleteMute
+	messageops    []*dbMessageOp
+	messagelock   sync.Mutex // protects messageops
+	messagewake   chan bool
+	insertautomod chan *AutomodDecision
+	insertaudit   chan *AuditEntry
 	sync.Mutex
 }
 
@@ -32,9 +39,45 @@ type dbDeleteBan struct {
 	uid Userid
 }
 
+type dbInsertMute struct {
+	uid       Userid
+	targetuid Userid
+	reason    string
+	starttime int64
+	endtime   int64
+	retries   uint8
+}
+
+type dbDeleteMute struct {
+	uid Userid
+}
+
+const (
+	MESSAGEINSERT = iota
+	MESSAGEDELETE
+	MESSAGEPURGE
+	MESSAGECLEAR
+)
+
+// dbMessageOp is a write to the messages table, they are queued without ever
+// blocking the hub and applied in order by runMessageWriter
+type dbMessageOp struct {
+	kind      int
+	id        int64
+	event     string
+	nick      string
+	data      string
+	timestamp int64
+}
+
 var db = &database{
-	insertban: make(chan *dbInsertBan, 10),
-	deleteban: make(chan *dbDeleteBan, 10),
+	insertban:     make(chan *dbInsertBan, 10),
+	deleteban:     make(chan *dbDeleteBan, 10),
+	insertmute:    make(chan *dbInsertMute, 10),
+	deletemute:    make(chan *dbDeleteMute, 10),
+	messagewake:   make(chan bool, 1),
+	insertautomod: make(chan *AutomodDecision, 10),
+	insertaudit:   make(chan *AuditEntry, 10),
 }
 
 func initDatabase(dbfile string, init bool) {
@@ -45,18 +88,25 @@ func initDatabase(dbfile string, init bool) {
 			panic(err)
 		}
 
-		stmt, err := db.db.Prepare(string(sql))
-		if err != nil {
+		// a prepared statement would only run the first CREATE TABLE
+		if _, err := db.db.Exec(string(sql)); err != nil {
 			panic(err)
 		}
-
-		stmt.Exec()
-		stmt.Close()
 	}
 
-	bans.loadActive()
 	go db.runInsertBan() // TODO ???
 	go db.runDeleteBan()
+	go db.runInsertMute()
+	go db.runDeleteMute()
+	go db.runMessageWriter(MSGCACHESIZE)
+	go db.runInsertAutomod()
+	go db.runInsertAudit()
+
+	bans.loadActive()
+	mutes.loadActive(state.legacymutes)
+	filters.load()
+	linkpolicy.load()
+	shadowbans.loadActive()
 }
 
 func (db *database) getStatement(name string, sql string) *sql.Stmt {
@@ -97,6 +147,38 @@ func (db *database) getDeleteBanStatement() *sql.Stmt {
 	`)
 }
 
+func (db *database) getInsertMuteStatement() *sql.Stmt {
+	return db.getStatement("insertMute", `
+		INSERT INTO mutes (
+			userid, targetuserid, reason, starttimestamp, endtimestamp
+		)
+		VALUES (
+			?, ?, ?, ?, ?
+		)
+	`)
+}
+
+func (db *database) getDeleteMuteStatement() *sql.Stmt {
+	return db.getStatement("deleteMute", `
+		UPDATE mutes
+		SET endtimestamp = strftime('%s', 'now')
+		WHERE
+			targetuserid = ? AND
+			endtimestamp > strftime('%s', 'now')
+	`)
+}
+
+func (db *database) getInsertAutomodStatement() *sql.Stmt {
+	return db.getStatement("insertAutomod", `
+		INSERT INTO automod (
+			userid, nick, message, rule, score, action, timestamp
+		)
+		VALUES (
+			?, ?, ?, ?, ?, ?, ?
+		)
+	`)
+}
+
 func (db *database) runInsertBan() {
 	t := time.NewTimer(time.Minute)
 	stmt := db.getInsertBanStatement()
@@ -153,6 +235,119 @@ func (db *database) runDeleteBan() {
 	}
 }
 
+func (db *database) runInsertMute() {
+	t := time.NewTimer(time.Minute)
+	stmt := db.getInsertMuteStatement()
+	for {
+		select {
+		case <-t.C:
+			stmt.Close()
+			stmt = nil
+		case data := <-db.insertmute:
+			t.Reset(time.Minute)
+			if stmt == nil {
+				stmt = db.getInsertMuteStatement()
+			}
+			if data.retries > 2 {
+				continue
+			}
+			db.Lock()
+			_, err := stmt.Exec(data.uid, data.targetuid, data.reason, data.starttime, data.endtime)
+			db.Unlock()
+			if err != nil {
+				data.retries++
+				D("Unable to insert mute", err)
+				go (func() {
+					db.insertmute <- data
+				})()
+			}
+		}
+	}
+}
+
+func (db *database) runDeleteMute() {
+	t := time.NewTimer(time.Minute)
+	stmt := db.getDeleteMuteStatement()
+	for {
+		select {
+		case <-t.C:
+			stmt.Close()
+			stmt = nil
+		case data := <-db.deletemute:
+			t.Reset(time.Minute)
+			if stmt == nil {
+				stmt = db.getDeleteMuteStatement()
+			}
+			db.Lock()
+			_, err := stmt.Exec(data.uid)
+			db.Unlock()
+			if err != nil {
+				D("Unable to delete mute", err)
+				go (func() {
+					db.deletemute <- data
+				})()
+			}
+		}
+	}
+}
+
+func (db *database) runInsertAutomod() {
+	t := time.NewTimer(time.Minute)
+	stmt := db.getInsertAutomodStatement()
+	for {
+		select {
+		case <-t.C:
+			stmt.Close()
+			stmt = nil
+		case d := <-db.insertautomod:
+			t.Reset(time.Minute)
+			if stmt == nil {
+				stmt = db.getInsertAutomodStatement()
+			}
+			db.Lock()
+			_, err := stmt.Exec(d.Userid, d.Nick, d.Message, d.Rule, d.Score, d.Action, d.Timestamp)
+			db.Unlock()
+			if err != nil {
+				D("Unable to insert automod decision", err)
+			}
+		}
+	}
+}
+
+func (db *database) getInsertAuditStatement() *sql.Stmt {
+	return db.getStatement("insertAudit", `
+		INSERT INTO audit_log (
+			userid, action, targetuserid, target, parameters, reason, timestamp
+		)
+		VALUES (
+			?, ?, ?, ?, ?, ?, ?
+		)
+	`)
+}
+
+func (db *database) runInsertAudit() {
+	t := time.NewTimer(time.Minute)
+	stmt := db.getInsertAuditStatement()
+	for {
+		select {
+		case <-t.C:
+			stmt.Close()
+			stmt = nil
+		case e := <-db.insertaudit:
+			t.Reset(time.Minute)
+			if stmt == nil {
+				stmt = db.getInsertAuditStatement()
+			}
+			db.Lock()
+			_, err := stmt.Exec(e.Userid, e.Action, e.Targetuserid, e.Target, e.Parameters, e.Reason, e.Timestamp)
+			db.Unlock()
+			if err != nil {
+				D("Unable to insert audit log entry", err)
+			}
+		}
+	}
+}
+
 func (db *database) insertBan(uid Userid, targetuid Userid, ban *BanIn, ip string) {
 	ipaddress := &sql.NullString{}
 	if ban.BanIP && len(ip) != 0 {
@@ -178,7 +373,342 @@ func (db *database) deleteBan(targetuid Userid) {
 	db.deleteban <- &dbDeleteBan{targetuid}
 }
 
-func (db *database) getBans(f func(Userid, sql.NullString, time.Time)) {
+func (db *database) insertMute(uid Userid, targetuid Userid, reason string, starttime time.Time, endtime time.Time) {
+	db.insertmute <- &dbInsertMute{uid, targetuid, reason, starttime.Unix(), endtime.Unix(), 0}
+}
+
+// migrateMute writes a mute of an older states file, unlike insertMute it
+// returns once the mute is stored
+func (db *database) migrateMute(targetuid Userid, starttime time.Time, endtime time.Time) error {
+	db.Lock()
+	defer db.Unlock()
+
+	_, err := db.db.Exec(`
+		INSERT INTO mutes (
+			userid, targetuserid, reason, starttimestamp, endtimestamp
+		)
+		VALUES (
+			0, ?, '', ?, ?
+		)
+	`, targetuid, starttime.Unix(), endtime.Unix())
+	if err != nil {
+		D("Unable to migrate mute", targetuid, err)
+	}
+	return err
+}
+
+func (db *database) deleteMute(targetuid Userid) {
+	db.deletemute <- &dbDeleteMute{targetuid}
+}
+
+// queueMessageOp never blocks, the queue grows while the writer is busy
+func (db *database) queueMessageOp(op *dbMessageOp) {
+	db.messagelock.Lock()
+	db.messageops = append(db.messageops, op)
+	db.messagelock.Unlock()
+
+	select {
+	case db.messagewake <- true:
+	default:
+	}
+}
+
+// runMessageWriter keeps the last limit events in the messages table
+func (db *database) runMessageWriter(limit int) {
+	for range db.messagewake {
+		db.messagelock.Lock()
+		ops := db.messageops
+		db.messageops = nil
+		db.messagelock.Unlock()
+
+		for retries := 0; retries < 3; retries++ {
+			err := db.writeMessageOps(ops, limit)
+			if err == nil {
+				break
+			}
+			D("Unable to write messages", err)
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+}
+
+// writeMessageOps applies the ops in one transaction, then drops the rows
+// older than the last limit ones, they can no longer be part of the history
+func (db *database) writeMessageOps(ops []*dbMessageOp, limit int) error {
+	db.Lock()
+	defer db.Unlock()
+
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	for _, op := range ops {
+		switch op.kind {
+		case MESSAGEINSERT:
+			_, err = tx.Exec(`
+				INSERT INTO messages (
+					id, event, nick, data, timestamp
+				)
+				VALUES (
+					?, ?, ?, ?, ?
+				)
+			`, op.id, op.event, op.nick, op.data, op.timestamp)
+		case MESSAGEDELETE:
+			_, err = tx.Exec(`
+				DELETE FROM messages
+				WHERE id = ?
+			`, op.id)
+		case MESSAGEPURGE:
+			_, err = tx.Exec(`
+				DELETE FROM messages
+				WHERE
+					event = 'MSG' AND
+					nick = ? COLLATE NOCASE
+			`, op.nick)
+		case MESSAGECLEAR:
+			_, err = tx.Exec(`
+				DELETE FROM messages
+				WHERE id < ?
+			`, op.id)
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	_, err = tx.Exec(`
+		DELETE FROM messages
+		WHERE id < (
+			SELECT IFNULL(MIN(id), 0)
+			FROM (
+				SELECT id
+				FROM messages
+				ORDER BY id DESC
+				LIMIT ?
+			)
+		)
+	`, limit)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (db *database) insertMessage(id int64, event string, nick string, data []byte) {
+	db.queueMessageOp(&dbMessageOp{
+		kind:      MESSAGEINSERT,
+		id:        id,
+		event:     event,
+		nick:      nick,
+		data:      string(data),
+		timestamp: time.Now().UTC().Unix(),
+	})
+}
+
+// deleteMessage is queued behind the insert of the message, so it can not
+// be written back after being deleted
+func (db *database) deleteMessage(id int64) {
+	db.queueMessageOp(&dbMessageOp{
+		kind: MESSAGEDELETE,
+		id:   id,
+	})
+}
+
+// getLastMessageID returns the highest message id ever reserved or stored,
+// unstored and pruned ids are covered by the reservation in sqlite_sequence
+func (db *database) getLastMessageID() int64 {
+	db.Lock()
+	defer db.Unlock()
+
+	var id int64
+	err := db.db.QueryRow(`
+		SELECT MAX(
+			IFNULL((SELECT seq FROM sqlite_sequence WHERE name = 'messages'), 0),
+			IFNULL((SELECT MAX(id) FROM messages), 0)
+		)
+	`).Scan(&id)
+	if err != nil {
+		D("Unable to get last message id: ", err)
+	}
+	return id
+}
+
+// reserveMessageIDs persists id as the high-water mark of the message ids
+func (db *database) reserveMessageIDs(id int64) error {
+	db.Lock()
+	defer db.Unlock()
+
+	res, err := db.db.Exec(`
+		UPDATE sqlite_sequence
+		SET seq = MAX(seq, ?)
+		WHERE name = 'messages'
+	`, id)
+	if err != nil {
+		D("Unable to reserve message ids: ", err)
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		return nil
+	}
+
+	_, err = db.db.Exec(`INSERT INTO sqlite_sequence (name, seq) VALUES ('messages', ?)`, id)
+	if err != nil {
+		D("Unable to reserve message ids: ", err)
+	}
+	return err
+}
+
+// purgeMessages deletes the chat messages of the nick, queued behind the
+// inserts of the messages broadcast before the PURGE
+func (db *database) purgeMessages(nick string) {
+	db.queueMessageOp(&dbMessageOp{
+		kind: MESSAGEPURGE,
+		nick: nick,
+	})
+}
+
+// clearMessages deletes every event older than the CLEAR with the given id
+func (db *database) clearMessages(id int64) {
+	db.queueMessageOp(&dbMessageOp{
+		kind: MESSAGECLEAR,
+		id:   id,
+	})
+}
+
+// getMessages calls f with the last limit chat events, oldest first
+// nothing before the last CLEAR is returned
+func (db *database) getMessages(limit int, f func(int64, string, string, []byte)) {
+	db.Lock()
+	defer db.Unlock()
+
+	rows, err := db.db.Query(`
+		SELECT id, event, nick, data
+		FROM (
+			SELECT id, event, IFNULL(nick, '') AS nick, data
+			FROM messages
+			WHERE id >= (
+				SELECT IFNULL(MAX(id), 0)
+				FROM messages
+				WHERE event = 'CLEAR'
+			)
+			ORDER BY id DESC
+			LIMIT ?
+		)
+		ORDER BY id ASC
+	`, limit)
+	if err != nil {
+		D("Unable to get messages: ", err)
+		return
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var event string
+		var nick string
+		var data string
+		err = rows.Scan(&id, &event, &nick, &data)
+		if err != nil {
+			D("Unable to scan messages row: ", err)
+			continue
+		}
+
+		f(id, event, nick, []byte(data))
+	}
+}
+
+func (db *database) insertAutomodDecision(d *AutomodDecision) {
+	db.insertautomod <- d
+}
+
+func (db *database) insertAuditEntry(e *AuditEntry) {
+	db.insertaudit <- e
+}
+
+// getAuditLog calls f with the entries matching the query, newest first
+func (db *database) getAuditLog(q *AuditQuery, f func(*AuditEntry)) {
+	where := []string{"1"}
+	args := []interface{}{}
+	if q.Userid != 0 {
+		where = append(where, "userid = ?")
+		args = append(args, q.Userid)
+	}
+	if q.Targetuserid != 0 {
+		where = append(where, "targetuserid = ?")
+		args = append(args, q.Targetuserid)
+	}
+	if q.From != 0 {
+		where = append(where, "timestamp >= ?")
+		args = append(args, q.From)
+	}
+	if q.To != 0 {
+		where = append(where, "timestamp <= ?")
+		args = append(args, q.To)
+	}
+	args = append(args, q.Limit)
+
+	db.Lock()
+	defer db.Unlock()
+
+	rows, err := db.db.Query(`
+		SELECT id, userid, action, targetuserid, target, parameters, reason, timestamp
+		FROM audit_log
+		WHERE `+strings.Join(where, " AND ")+`
+		ORDER BY id DESC
+		LIMIT ?
+	`, args...)
+	if err != nil {
+		D("Unable to get audit log: ", err)
+		return
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		e := &AuditEntry{}
+		err = rows.Scan(&e.Id, &e.Userid, &e.Action, &e.Targetuserid, &e.Target, &e.Parameters, &e.Reason, &e.Timestamp)
+		if err != nil {
+			D("Unable to scan audit log row: ", err)
+			continue
+		}
+
+		f(e)
+	}
+}
+
+// getAutomodDecisions calls f with the last limit decisions, newest first
+func (db *database) getAutomodDecisions(limit int, f func(*AutomodDecision)) {
+	db.Lock()
+	defer db.Unlock()
+
+	rows, err := db.db.Query(`
+		SELECT userid, nick, message, rule, score, action, timestamp
+		FROM automod
+		ORDER BY timestamp DESC
+		LIMIT ?
+	`, limit)
+	if err != nil {
+		D("Unable to get automod decisions: ", err)
+		return
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		d := &AutomodDecision{}
+		err = rows.Scan(&d.Userid, &d.Nick, &d.Message, &d.Rule, &d.Score, &d.Action, &d.Timestamp)
+		if err != nil {
+			D("Unable to scan automod row: ", err)
+			continue
+		}
+
+		f(d)
+	}
+}
+
+func (db *database) getBans(f func(Userid, sql.NullString, string, time.Time)) {
 	db.Lock()
 	defer db.Unlock()
 
@@ -186,6 +716,7 @@ func (db *database) getBans(f func(Userid, sql.NullString, time.Time)) {
 		SELECT
 			targetuserid,
 			ipaddress,
+			reason,
 			endtimestamp
 		FROM bans
 		WHERE
@@ -202,9 +733,10 @@ func (db *database) getBans(f func(Userid, sql.NullString, time.Time)) {
 	for rows.Next() {
 		var uid Userid
 		var ipaddress sql.NullString
+		var reason sql.NullString
 		var endtimestamp time.Time
 		var t int64
-		err = rows.Scan(&uid, &ipaddress, &t)
+		err = rows.Scan(&uid, &ipaddress, &reason, &t)
 		if err != nil {
 			D("Unable to scan bans row: ", err)
 			continue
@@ -212,10 +744,368 @@ func (db *database) getBans(f func(Userid, sql.NullString, time.Time)) {
 
 		endtimestamp = time.Unix(t, 0).UTC()
 
-		f(uid, ipaddress, endtimestamp)
+		f(uid, ipaddress, reason.String, endtimestamp)
 	}
 }
 
+func (db *database) getMutes(f func(Userid, time.Time)) {
+	db.Lock()
+	defer db.Unlock()
+
+	rows, err := db.db.Query(`
+		SELECT
+			targetuserid,
+			MAX(endtimestamp)
+		FROM mutes
+		WHERE endtimestamp > strftime('%s', 'now')
+		GROUP BY targetuserid
+	`)
+	if err != nil {
+		D("Unable to get active mutes: ", err)
+		return
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		var uid Userid
+		var t int64
+		err = rows.Scan(&uid, &t)
+		if err != nil {
+			D("Unable to scan mutes row: ", err)
+			continue
+		}
+
+		f(uid, time.Unix(t, 0).UTC())
+	}
+}
+
+// getBanReason returns the reason of the latest active ban of the ip,
+// or of the user itself if the ip is empty
+func (db *database) getBanReason(uid Userid, ip string) (string, error) {
+	db.Lock()
+	defer db.Unlock()
+
+	var reason sql.NullString
+	var err error
+	if ip != "" {
+		err = db.db.QueryRow(`
+			SELECT reason
+			FROM bans
+			WHERE
+				ipaddress = ? AND
+				(
+					endtimestamp IS NULL OR
+					endtimestamp > strftime('%s', 'now')
+				)
+			ORDER BY starttimestamp DESC
+			LIMIT 1
+		`, ip).Scan(&reason)
+	} else {
+		err = db.db.QueryRow(`
+			SELECT reason
+			FROM bans
+			WHERE
+				targetuserid = ? AND
+				ipaddress IS NULL AND
+				(
+					endtimestamp IS NULL OR
+					endtimestamp > strftime('%s', 'now')
+				)
+			ORDER BY starttimestamp DESC
+			LIMIT 1
+		`, uid).Scan(&reason)
+	}
+
+	return reason.String, err
+}
+
+func (db *database) getFilters(f func(*Filter)) {
+	db.Lock()
+	defer db.Unlock()
+
+	rows, err := db.db.Query(`
+		SELECT
+			id,
+			pattern,
+			isregex,
+			action,
+			IFNULL(duration, 0)
+		FROM filters
+		ORDER BY id ASC
+	`)
+	if err != nil {
+		D("Unable to get filters: ", err)
+		return
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		filter := &Filter{}
+		err = rows.Scan(&filter.Id, &filter.Pattern, &filter.Regex, &filter.Action, &filter.Duration)
+		if err != nil {
+			D("Unable to scan filters row: ", err)
+			continue
+		}
+
+		f(filter)
+	}
+}
+
+func (db *database) insertFilter(uid Userid, filter *Filter) error {
+	stmt := db.getStatement("insertFilter", `
+		INSERT INTO filters (
+			userid, pattern, isregex, action, duration, createdtimestamp
+		)
+		VALUES (
+			?, ?, ?, ?, ?, strftime('%s', 'now')
+		)
+	`)
+	db.Lock()
+	defer stmt.Close()
+	defer db.Unlock()
+
+	res, err := stmt.Exec(uid, filter.Pattern, filter.Regex, filter.Action, filter.Duration)
+	if err != nil {
+		D("insertFilter err", err)
+		return err
+	}
+
+	filter.Id, _ = res.LastInsertId()
+	return nil
+}
+
+func (db *database) deleteFilter(id int64) (bool, error) {
+	stmt := db.getStatement("deleteFilter", `
+		DELETE FROM filters
+		WHERE id = ?
+	`)
+	db.Lock()
+	defer stmt.Close()
+	defer db.Unlock()
+
+	res, err := stmt.Exec(id)
+	if err != nil {
+		D("deleteFilter err", err)
+		return false, err
+	}
+
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+func (db *database) getLinkDomains(f func(string, string)) {
+	db.Lock()
+	defer db.Unlock()
+
+	rows, err := db.db.Query(`
+		SELECT domain, list
+		FROM linkdomains
+	`)
+	if err != nil {
+		D("Unable to get link domains: ", err)
+		return
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		var domain, list string
+		err = rows.Scan(&domain, &list)
+		if err != nil {
+			D("Unable to scan linkdomains row: ", err)
+			continue
+		}
+
+		f(domain, list)
+	}
+}
+
+func (db *database) setLinkDomain(domain string, list string) error {
+	stmt := db.getStatement("setLinkDomain", `
+		INSERT OR REPLACE INTO linkdomains (
+			domain, list
+		)
+		VALUES (
+			?, ?
+		)
+	`)
+	db.Lock()
+	defer stmt.Close()
+	defer db.Unlock()
+
+	_, err := stmt.Exec(domain, list)
+	if err != nil {
+		D("setLinkDomain err", err)
+		return err
+	}
+
+	return nil
+}
+
+func (db *database) deleteLinkDomain(domain string) error {
+	stmt := db.getStatement("deleteLinkDomain", `
+		DELETE FROM linkdomains
+		WHERE domain = ?
+	`)
+	db.Lock()
+	defer stmt.Close()
+	defer db.Unlock()
+
+	_, err := stmt.Exec(domain)
+	if err != nil {
+		D("deleteLinkDomain err", err)
+		return err
+	}
+
+	return nil
+}
+
+func (db *database) insertReport(r *Report) error {
+	stmt := db.getStatement("insertReport", `
+		INSERT INTO reports (
+			userid, nick, targetuserid, targetnick, messageid, message, reason, timestamp
+		)
+		VALUES (
+			?, ?, ?, ?, ?, ?, ?, ?
+		)
+	`)
+	db.Lock()
+	defer stmt.Close()
+	defer db.Unlock()
+
+	res, err := stmt.Exec(r.userid, r.Nick, r.targetuid, r.Targetnick, r.Messageid, r.Message, r.Reason, r.Timestamp)
+	if err != nil {
+		D("insertReport err", err)
+		return err
+	}
+
+	r.Id, _ = res.LastInsertId()
+	return nil
+}
+
+// getOpenReports calls f with every unresolved report, oldest first
+func (db *database) getOpenReports(f func(*Report)) {
+	db.Lock()
+	defer db.Unlock()
+
+	rows, err := db.db.Query(`
+		SELECT
+			id, nick, targetnick, IFNULL(messageid, 0), IFNULL(message, ''), reason, timestamp
+		FROM reports
+		WHERE resolvedby IS NULL
+		ORDER BY id ASC
+	`)
+	if err != nil {
+		D("Unable to get reports: ", err)
+		return
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		r := &Report{}
+		err = rows.Scan(&r.Id, &r.Nick, &r.Targetnick, &r.Messageid, &r.Message, &r.Reason, &r.Timestamp)
+		if err != nil {
+			D("Unable to scan reports row: ", err)
+			continue
+		}
+
+		f(r)
+	}
+}
+
+// resolveReport returns false if the report does not exist or was resolved already
+func (db *database) resolveReport(id int64, uid Userid) (bool, error) {
+	stmt := db.getStatement("resolveReport", `
+		UPDATE reports SET
+			resolvedby = ?,
+			resolvedtimestamp = strftime('%s', 'now')
+		WHERE
+			id = ? AND
+			resolvedby IS NULL
+	`)
+	db.Lock()
+	defer stmt.Close()
+	defer db.Unlock()
+
+	res, err := stmt.Exec(uid, id)
+	if err != nil {
+		D("resolveReport err", err)
+		return false, err
+	}
+
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+func (db *database) getShadowbans(f func(Userid)) {
+	db.Lock()
+	defer db.Unlock()
+
+	rows, err := db.db.Query(`
+		SELECT DISTINCT targetuserid
+		FROM shadowbans
+		WHERE endtimestamp IS NULL
+	`)
+	if err != nil {
+		D("Unable to get shadowbans: ", err)
+		return
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		var uid Userid
+		err = rows.Scan(&uid)
+		if err != nil {
+			D("Unable to scan shadowbans row: ", err)
+			continue
+		}
+
+		f(uid)
+	}
+}
+
+func (db *database) insertShadowban(uid Userid, targetuid Userid) error {
+	stmt := db.getStatement("insertShadowban", `
+		INSERT INTO shadowbans (
+			userid, targetuserid, starttimestamp
+		)
+		VALUES (
+			?, ?, strftime('%s', 'now')
+		)
+	`)
+	db.Lock()
+	defer stmt.Close()
+	defer db.Unlock()
+
+	_, err := stmt.Exec(uid, targetuid)
+	if err != nil {
+		D("insertShadowban err", err)
+		return err
+	}
+
+	return nil
+}
+
+func (db *database) deleteShadowban(targetuid Userid) error {
+	stmt := db.getStatement("deleteShadowban", `
+		UPDATE shadowbans
+		SET endtimestamp = strftime('%s', 'now')
+		WHERE
+			targetuserid = ? AND
+			endtimestamp IS NULL
+	`)
+	db.Lock()
+	defer stmt.Close()
+	defer db.Unlock()
+
+	_, err := stmt.Exec(targetuid)
+	if err != nil {
+		D("deleteShadowban err", err)
+		return err
+	}
+
+	return nil
+}
+
 func (db *database) getUser(nick string) (Userid, bool) {
 	stmt := db.getStatement("getUser", `
 		SELECT
@@ -239,11 +1129,26 @@ func (db *database) getUser(nick string) (Userid, bool) {
 	return Userid(uid), protected
 }
 
+func (db *database) getNick(uid Userid) (string, error) {
+	stmt := db.getStatement("getNick", `
+		SELECT nick
+		FROM users
+		WHERE userid = ?
+	`)
+	db.Lock()
+	defer stmt.Close()
+	defer db.Unlock()
+
+	var nick string
+	err := stmt.QueryRow(uid).Scan(&nick)
+	return nick, err
+}
+
 // TODO ... for uuid-id conversion
-func (db *database) getUserInfo(uuid string) ([]string, int, error) {
+func (db *database) getUserInfo(uuid string) ([]string, int, time.Time, error) {
 	stmt := db.getStatement("getUserInfo", `
 		SELECT
-			userid, features
+			userid, features, IFNULL(firstlogin, 0)
 		FROM users
 		WHERE uuid = ?
 	`)
@@ -253,13 +1158,46 @@ func (db *database) getUserInfo(uuid string) ([]string, int, error) {
 
 	var f string
 	var uid int
-	err := stmt.QueryRow(uuid).Scan(&uid, &f)
+	var firstlogin int64
+	err := stmt.QueryRow(uuid).Scan(&uid, &f, &firstlogin)
 	if err != nil {
 		D("features err", err)
-		return []string{}, -1, err // TODO -1 implications...
+		return []string{}, -1, time.Time{}, err // TODO -1 implications...
 	}
 	features := strings.Split(f, ",") // TODO features are placed into db like this...
-	return features, uid, nil
+	return features, uid, time.Unix(firstlogin, 0).UTC(), nil
+}
+
+// getUserByUUID returns the user as stored in the database, used for api requests
+func (db *database) getUserByUUID(uuid string) (*User, error) {
+	stmt := db.getStatement("getUserByUUID", `
+		SELECT
+			userid, nick, features, IFNULL(firstlogin, 0)
+		FROM users
+		WHERE uuid = ?
+	`)
+	db.Lock()
+	defer stmt.Close()
+	defer db.Unlock()
+
+	var uid int32
+	var nick, f string
+	var firstlogin int64
+	err := stmt.QueryRow(uuid).Scan(&uid, &nick, &f, &firstlogin)
+	if err != nil {
+		D("getUserByUUID err", err)
+		return nil, err
+	}
+
+	u := &User{
+		id:         Userid(uid),
+		nick:       nick,
+		firstlogin: time.Unix(firstlogin, 0).UTC(),
+		delayscale: 1,
+	}
+	u.setFeatures(strings.Split(f, ","))
+	u.assembleSimplifiedUser()
+	return u, nil
 }
 
 func (db *database) newUser(uuid string, name string, ip string) error {
@@ -288,6 +1226,76 @@ func (db *database) newUser(uuid string, name string, ip string) error {
 	return nil
 }
 
+// insertUserIP records a login of the user from the ip
+func (db *database) insertUserIP(id Userid, ip string) error {
+	insert := db.getStatement("insertUserIP", `
+		INSERT OR IGNORE INTO user_ips (
+			userid, ipaddress, firstseen, lastseen
+		)
+		VALUES (
+			?, ?, strftime('%s', 'now'), strftime('%s', 'now')
+		)
+	`)
+	update := db.getStatement("updateUserIP", `
+		UPDATE user_ips
+		SET lastseen = strftime('%s', 'now')
+		WHERE
+			userid = ? AND
+			ipaddress = ?
+	`)
+	db.Lock()
+	defer insert.Close()
+	defer update.Close()
+	defer db.Unlock()
+
+	res, err := insert.Exec(id, ip)
+	if err != nil {
+		D("insertUserIP err", err)
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		return nil
+	}
+
+	_, err = update.Exec(id, ip)
+	if err != nil {
+		D("updateUserIP err", err)
+		return err
+	}
+
+	return nil
+}
+
+// getUserIPs returns the ips the user logged in from since the given time,
+// most recent first
+func (db *database) getUserIPs(id Userid, since time.Time) ([]string, error) {
+	db.Lock()
+	defer db.Unlock()
+
+	rows, err := db.db.Query(`
+		SELECT ipaddress
+		FROM user_ips
+		WHERE
+			userid = ? AND
+			lastseen >= ?
+		ORDER BY lastseen DESC
+	`, id, since.Unix())
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	ips := []string{}
+	for rows.Next() {
+		var ip string
+		if err := rows.Scan(&ip); err != nil {
+			return nil, err
+		}
+		ips = append(ips, ip)
+	}
+	return ips, rows.Err()
+}
+
 func (db *database) updateUser(id Userid, name string, ip string) error {
 	stmt := db.getStatement("updateUser", `
 		UPDATE users SET 
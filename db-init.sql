@@ -16,3 +16,86 @@ CREATE TABLE IF NOT EXISTS bans (
     starttimestamp INTEGER, /* unix epoch */ 
     endtimestamp INTEGER /* unix epoch */ 
 );
+
+CREATE TABLE IF NOT EXISTS messages (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    event TEXT NOT NULL, /* MSG, BROADCAST, MUTE, ... */
+    nick TEXT, /* the author, empty for system events */
+    data TEXT NOT NULL, /* the marshalled event json */
+    timestamp INTEGER /* unix epoch */
+);
+
+CREATE TABLE IF NOT EXISTS filters (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    userid INTEGER NOT NULL, /* the admin who added it */
+    pattern TEXT NOT NULL,
+    isregex INTEGER NOT NULL, /* 0 matches the pattern literally, case insensitive */
+    action TEXT NOT NULL, /* reject, hold, mute or ban */
+    duration INTEGER, /* nanoseconds, for mute and ban */
+    createdtimestamp INTEGER /* unix epoch */
+);
+
+CREATE TABLE IF NOT EXISTS linkdomains (
+    domain TEXT NOT NULL PRIMARY KEY, /* lowercase, subdomains match too */
+    list TEXT NOT NULL /* allow or block */
+);
+
+CREATE TABLE IF NOT EXISTS automod (
+    userid INTEGER NOT NULL, /* the author of the message */
+    nick TEXT NOT NULL,
+    message TEXT NOT NULL,
+    rule TEXT NOT NULL, /* caps, repeat, mentions, emotes or links */
+    score REAL NOT NULL, /* above 1 the threshold was exceeded */
+    action TEXT NOT NULL, /* reject, hold or mute */
+    timestamp INTEGER /* unix epoch in milliseconds */
+);
+
+CREATE TABLE IF NOT EXISTS reports (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    userid INTEGER NOT NULL, /* the reporter */
+    nick TEXT NOT NULL,
+    targetuserid INTEGER NOT NULL,
+    targetnick TEXT NOT NULL,
+    messageid INTEGER, /* 0 when a nick was reported */
+    message TEXT, /* the reported message as it was at the time */
+    reason TEXT NOT NULL,
+    timestamp INTEGER, /* unix epoch in milliseconds */
+    resolvedby INTEGER, /* NULL while open */
+    resolvedtimestamp INTEGER /* unix epoch */
+);
+
+CREATE TABLE IF NOT EXISTS shadowbans (
+    userid INTEGER NOT NULL, /* the moderator */
+    targetuserid INTEGER NOT NULL,
+    starttimestamp INTEGER, /* unix epoch */
+    endtimestamp INTEGER /* unix epoch, NULL while active */
+);
+
+CREATE TABLE IF NOT EXISTS mutes (
+    userid INTEGER NOT NULL, /* the moderator, 0 for automatic mutes */
+    targetuserid INTEGER NOT NULL,
+    reason TEXT,
+    starttimestamp INTEGER, /* unix epoch */
+    endtimestamp INTEGER /* unix epoch */
+);
+
+CREATE TABLE IF NOT EXISTS audit_log (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    userid INTEGER NOT NULL, /* the moderator, 0 for automatic actions */
+    action TEXT NOT NULL, /* BAN, MUTE, SUBONLY, ... */
+    targetuserid INTEGER,
+    target TEXT,
+    parameters TEXT, /* json */
+    reason TEXT,
+    timestamp INTEGER NOT NULL /* unix epoch in milliseconds */
+);
+
+CREATE INDEX IF NOT EXISTS audit_log_timestamp ON audit_log (timestamp);
+
+CREATE TABLE IF NOT EXISTS user_ips (
+    userid INTEGER NOT NULL,
+    ipaddress TEXT NOT NULL, /* masked like the bans */
+    firstseen INTEGER, /* unix epoch */
+    lastseen INTEGER, /* unix epoch */
+    PRIMARY KEY (userid, ipaddress)
+);
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"strings"
+)
+
+const (
+	DUPLICATEHISTORY   = 3  // previous messages of a user compared against
+	DUPLICATEMINLENGTH = 10 // shorter messages only count if repeated exactly
+)
+
+func normalizeDuplicate(msg string) string {
+	return strings.Join(strings.Fields(strings.ToLower(msg)), " ")
+}
+
+// isDuplicate checks if the message repeats the last one, or is too similar to
+// one of the last few
+func (u *User) isDuplicate(msg string) bool {
+	n := normalizeDuplicate(msg)
+	if len(u.lastmessages) == 0 {
+		return false
+	}
+	if u.lastmessages[len(u.lastmessages)-1] == n {
+		return true
+	}
+
+	r := []rune(n)
+	if len(r) < DUPLICATEMINLENGTH {
+		return false
+	}
+	for _, prev := range u.lastmessages {
+		p := []rune(prev)
+		if len(p) >= DUPLICATEMINLENGTH && similarity(r, p) >= DUPLICATESIMILARITY {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *User) addMessage(msg string) {
+	u.lastmessages = append(u.lastmessages, normalizeDuplicate(msg))
+	if len(u.lastmessages) > DUPLICATEHISTORY {
+		u.lastmessages = u.lastmessages[1:]
+	}
+}
+
+// similarity returns 1 for equal texts down to 0 for completely different ones,
+// based on the edit distance
+func similarity(a, b []rune) float64 {
+	longest := len(a)
+	if len(b) > longest {
+		longest = len(b)
+	}
+	if longest == 0 {
+		return 1
+	}
+	return 1 - float64(levenshtein(a, b))/float64(longest)
+}
+
+func levenshtein(a, b []rune) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestIsDuplicate(t *testing.T) {
+	u := &User{}
+
+	if u.isDuplicate("lol") {
+		t.Error("first message should not be a duplicate")
+	}
+	u.addMessage("lol")
+	if !u.isDuplicate("LOL") {
+		t.Error("repeating the last message should be a duplicate")
+	}
+
+	u.addMessage("this is a long copypasta about chat")
+	if !u.isDuplicate("this is a long copypasta about chat!") {
+		t.Error("adding a character should still be a duplicate")
+	}
+	if u.isDuplicate("something completely different here") {
+		t.Error("a different message should not be a duplicate")
+	}
+
+	u.addMessage("ok")
+	if u.isDuplicate("lol") {
+		t.Error("short messages should only be duplicates of the last message")
+	}
+	if !u.isDuplicate("this is a long copypasta about chat.") {
+		t.Error("similar to an older message should be a duplicate")
+	}
+
+	u.addMessage("one")
+	u.addMessage("two")
+	if u.isDuplicate("this is a long copypasta about chat.") {
+		t.Error("messages older than the history should be forgotten")
+	}
+}
+
+func TestRejectedMessageIsNotDuplicate(t *testing.T) {
+	initEntities()
+	state.emoteonly = true
+	defer func() { state.emoteonly = false }()
+
+	c := &Connection{blocksend: make(chan *message, 4)}
+	c.user = &User{id: 31340, nick: "retrying"}
+	c.user.assembleSimplifiedUser()
+	c.OnMsg([]byte(`{"data":"not an emote"}`))
+
+	if m := <-c.blocksend; m.data != "emoteonly" {
+		t.Fatalf("expected the message to be rejected, got %+v", m)
+	}
+	if c.user.isDuplicate("not an emote") {
+		t.Error("a rejected message should not count for the duplicate check")
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+const (
+	EXPIREBAN = iota
+	EXPIREMUTE
+)
+
+type expiration struct {
+	kind int
+	uid  Userid
+	at   time.Time
+}
+
+type expirationHeap []*expiration
+
+func (h expirationHeap) Len() int            { return len(h) }
+func (h expirationHeap) Less(i, j int) bool  { return h[i].at.Before(h[j].at) }
+func (h expirationHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *expirationHeap) Push(x interface{}) { *h = append(*h, x.(*expiration)) }
+func (h *expirationHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	e := old[n-1]
+	*h = old[:n-1]
+	return e
+}
+
+// Expirations fires exactly when a ban or a mute runs out, so that clients
+// get told about it instead of the entry silently disappearing
+type Expirations struct {
+	queue expirationHeap
+	wake  chan bool
+	sync.Mutex
+}
+
+var expirations = Expirations{wake: make(chan bool, 1)}
+
+// schedule is safe to call with the ban or mute locks held, it never blocks
+func (e *Expirations) schedule(kind int, uid Userid, at time.Time) {
+	e.Lock()
+	heap.Push(&e.queue, &expiration{kind, uid, at})
+	e.Unlock()
+
+	select {
+	case e.wake <- true:
+	default:
+	}
+}
+
+// due pops the expirations that are in the past and returns how long to
+// wait for the next one
+func (e *Expirations) due() ([]*expiration, time.Duration) {
+	e.Lock()
+	defer e.Unlock()
+
+	var expired []*expiration
+	now := time.Now().UTC()
+	for len(e.queue) > 0 && !e.queue[0].at.After(now) {
+		expired = append(expired, heap.Pop(&e.queue).(*expiration))
+	}
+
+	if len(e.queue) == 0 {
+		return expired, time.Hour
+	}
+	return expired, e.queue[0].at.Sub(now)
+}
+
+func (e *Expirations) run() {
+	t := time.NewTimer(0)
+	for {
+		select {
+		case <-t.C:
+		case <-e.wake:
+			if !t.Stop() {
+				select {
+				case <-t.C:
+				default:
+				}
+			}
+		}
+
+		expired, wait := e.due()
+		for _, x := range expired {
+			e.expire(x)
+		}
+		t.Reset(wait)
+	}
+}
+
+func (e *Expirations) expire(x *expiration) {
+	var event string
+	switch x.kind {
+	case EXPIREBAN:
+		if !bans.expireUserid(x.uid, x.at) {
+			return
+		}
+		event = "UNBAN"
+	case EXPIREMUTE:
+		if !mutes.expireUserid(x.uid, x.at) {
+			return
+		}
+		event = "UNMUTE"
+	}
+
+	nick, err := db.getNick(x.uid)
+	if err != nil {
+		D("Unable to look up nick of expired", event, x.uid, err)
+		return
+	}
+
+	broadcastFrom(nil, event, &EventDataOut{
+		Timestamp:    unixMilliTime(),
+		Data:         nick,
+		Targetuserid: x.uid,
+	})
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExpirationsDue(t *testing.T) {
+	e := Expirations{wake: make(chan bool, 1)}
+	now := time.Now().UTC()
+	e.schedule(EXPIREMUTE, 1, now.Add(time.Minute))
+	e.schedule(EXPIREBAN, 2, now.Add(-time.Second))
+	e.schedule(EXPIREMUTE, 3, now.Add(-time.Minute))
+
+	expired, wait := e.due()
+	if len(expired) != 2 || expired[0].uid != 3 || expired[1].uid != 2 {
+		t.Fatalf("expected the two past expirations in order, got %+v", expired)
+	}
+	if wait <= 0 || wait > time.Minute {
+		t.Errorf("expected to wait for the remaining one, got %v", wait)
+	}
+}
+
+func TestExpireMute(t *testing.T) {
+	db.newUser("expire-test-uuid", "expirednick", "10.0.0.2")
+	uid, _ := db.getUser("expirednick")
+	for len(hub.broadcast) > 0 {
+		<-hub.broadcast
+	}
+
+	at := time.Now().UTC()
+	state.mutes[uid] = at.Add(time.Minute)
+	expirations.expire(&expiration{EXPIREMUTE, uid, at})
+	if len(hub.broadcast) != 0 || state.mutes[uid].IsZero() {
+		t.Fatal("a mute that was changed since should not expire")
+	}
+
+	state.mutes[uid] = at
+	expirations.expire(&expiration{EXPIREMUTE, uid, at})
+	if _, ok := state.mutes[uid]; ok {
+		t.Error("the mute should be removed")
+	}
+	if len(hub.broadcast) != 1 {
+		t.Fatal("expected an UNMUTE event")
+	}
+	if m := <-hub.broadcast; m.event != "UNMUTE" || m.nick != "" {
+		t.Errorf("expected a system UNMUTE event, got %+v", m)
+	}
+}
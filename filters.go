@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"sync"
+	"time"
+)
+
+const (
+	FILTERREJECT = "reject"
+	FILTERHOLD   = "hold" // chat messages wait for review, private messages are rejected
+	FILTERMUTE   = "mute"
+	FILTERBAN    = "ban"
+)
+
+var (
+	ErrInvalidFilter  = errors.New("invalid filter")
+	ErrFilterNotFound = errors.New("filter not found")
+)
+
+type Filter struct {
+	Id       int64  `json:"id"`
+	Pattern  string `json:"pattern"`
+	Regex    bool   `json:"regex"`
+	Action   string `json:"action"`
+	Duration int64  `json:"duration,omitempty"`
+	re       *regexp.Regexp
+}
+
+type Filters struct {
+	rules []*Filter
+	sync.RWMutex
+}
+
+var filters = Filters{}
+
+func (f *Filter) compile() (err error) {
+	if f.Regex {
+		f.re, err = regexp.Compile(f.Pattern)
+	} else {
+		f.re, err = regexp.Compile(`(?i)` + regexp.QuoteMeta(f.Pattern))
+	}
+	return
+}
+
+// load replaces the compiled rules with the ones in the database
+func (f *Filters) load() {
+	rules := []*Filter{}
+	db.getFilters(func(filter *Filter) {
+		if err := filter.compile(); err != nil {
+			D("Unable to compile filter", filter.Id, filter.Pattern, err)
+			return
+		}
+		rules = append(rules, filter)
+	})
+
+	f.Lock()
+	defer f.Unlock()
+	f.rules = rules
+}
+
+func (f *Filters) add(uid Userid, filter *Filter) error {
+	if filter.Pattern == "" || filter.Duration < 0 || time.Duration(filter.Duration) > 7*24*time.Hour {
+		return ErrInvalidFilter
+	}
+	switch filter.Action {
+	case FILTERREJECT, FILTERHOLD, FILTERMUTE, FILTERBAN:
+	default:
+		return ErrInvalidFilter
+	}
+	if err := filter.compile(); err != nil {
+		return ErrInvalidFilter
+	}
+
+	if err := db.insertFilter(uid, filter); err != nil {
+		return err
+	}
+	f.load()
+	return nil
+}
+
+func (f *Filters) remove(id int64) error {
+	ok, err := db.deleteFilter(id)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrFilterNotFound
+	}
+	f.load()
+	return nil
+}
+
+func (f *Filters) list() []*Filter {
+	f.RLock()
+	defer f.RUnlock()
+
+	out := make([]*Filter, len(f.rules))
+	copy(out, f.rules)
+	return out
+}
+
+// match returns the first filter matching the message, or nil
+func (f *Filters) match(msg string) *Filter {
+	f.RLock()
+	defer f.RUnlock()
+
+	for _, filter := range f.rules {
+		if filter.re.MatchString(msg) {
+			return filter
+		}
+	}
+	return nil
+}
+
+// apply runs the action of the filter against the author of the message
+func (f *Filter) apply(c *Connection) {
+	D("Filter", f.Id, "matched message of", c.user.nick, "action:", f.Action)
+
+	switch f.Action {
+	case FILTERMUTE:
+		duration := f.Duration
+		if duration == 0 {
+			duration = int64(DEFAULTMUTEDURATION)
+		}
+		c.autoMute(duration, "filtered message")
+	case FILTERBAN:
+		ban := &BanIn{
+			Nick:     c.user.nick,
+			Duration: f.Duration,
+			Reason:   "filtered message",
+		}
+		if ban.Duration == 0 {
+			ban.Duration = int64(DEFAULTBANDURATION)
+		}
+		bans.banUser(0, c.user.id, ban)
+		audit(0, "BAN", c.user.id, c.user.nick, map[string]int64{"duration": ban.Duration}, ban.Reason)
+		broadcastFrom(nil, "BAN", &EventDataOut{
+			Targetuserid: c.user.id,
+			Timestamp:    unixMilliTime(),
+			Data:         c.user.nick,
+		})
+	default:
+		c.SendError("filtered")
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestFilters(t *testing.T) {
+	literal := &Filter{Pattern: "Bad.Word", Action: FILTERREJECT}
+	if err := filters.add(1, literal); err != nil {
+		t.Fatal("unable to add literal filter", err)
+	}
+	regex := &Filter{Pattern: `^spam\d+$`, Regex: true, Action: FILTERMUTE}
+	if err := filters.add(1, regex); err != nil {
+		t.Fatal("unable to add regex filter", err)
+	}
+	defer filters.remove(literal.Id)
+	defer filters.remove(regex.Id)
+
+	if f := filters.match("what a bad.word to say"); f == nil || f.Id != literal.Id {
+		t.Error("literal filter should match case insensitive", f)
+	}
+	if f := filters.match("what a badXword to say"); f != nil {
+		t.Error("literal filter should not be treated as a regexp", f)
+	}
+	if f := filters.match("spam123"); f == nil || f.Id != regex.Id {
+		t.Error("regex filter should match", f)
+	}
+
+	if err := filters.add(1, &Filter{Pattern: "(", Regex: true, Action: FILTERREJECT}); err != ErrInvalidFilter {
+		t.Error("invalid regexp should not be added", err)
+	}
+	if err := filters.add(1, &Filter{Pattern: "x", Action: "explode"}); err != ErrInvalidFilter {
+		t.Error("unknown action should not be added", err)
+	}
+
+	filters.remove(literal.Id)
+	if f := filters.match("bad.word"); f != nil {
+		t.Error("removed filter should not match anymore", f)
+	}
+	if err := filters.remove(literal.Id); err != ErrFilterNotFound {
+		t.Error("removing a filter twice should not find it", err)
+	}
+}
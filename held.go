@@ -0,0 +1,84 @@
+package main
+
+import (
+	"sync"
+)
+
+// at most this many messages wait for review, the oldest are dropped first
+const MAXHELDMESSAGES = 200
+
+type HeldMessage struct {
+	Id      int64         `json:"id"`
+	Reason  string        `json:"reason"`
+	Message *EventDataOut `json:"message"`
+	userid  Userid
+}
+
+type HeldIn struct {
+	Id int64 `json:"id"`
+}
+
+type HeldResolvedOut struct {
+	Id        int64  `json:"id"`
+	Nick      string `json:"nick"` // the moderator
+	Timestamp int64  `json:"timestamp"`
+}
+
+// HeldMessages is the queue of messages waiting for a moderator to review them
+type HeldMessages struct {
+	lastid   int64
+	messages []*HeldMessage // oldest first
+	sync.Mutex
+}
+
+var held = HeldMessages{}
+
+// hold puts the message of the connection into the queue instead of sending it
+func (h *HeldMessages) hold(c *Connection, out *EventDataOut, reason string) {
+	// the message keeps its own copy of the user, it is sent without any locks held
+	c.rlockUserIfExists()
+	su := *out.SimplifiedUser
+	c.runlockUserIfExists()
+	out.SimplifiedUser = &su
+
+	h.Lock()
+	h.lastid++
+	m := &HeldMessage{
+		Id:      h.lastid,
+		Reason:  reason,
+		Message: out,
+		userid:  c.user.id,
+	}
+	h.messages = append(h.messages, m)
+	if len(h.messages) > MAXHELDMESSAGES {
+		h.messages = h.messages[1:]
+	}
+	h.Unlock()
+
+	D("Held message", m.Id, "of", su.Nick, "reason:", reason)
+	hub.emitToModerators("HELD", m)
+	c.SendError("held")
+}
+
+// take removes the message from the queue, nil if it does not exist
+func (h *HeldMessages) take(id int64) *HeldMessage {
+	h.Lock()
+	defer h.Unlock()
+
+	for i, m := range h.messages {
+		if m.Id == id {
+			h.messages = append(h.messages[:i], h.messages[i+1:]...)
+			return m
+		}
+	}
+	return nil
+}
+
+func (h *HeldMessages) list() []*HeldMessage {
+	h.Lock()
+	defer h.Unlock()
+
+	out := make([]*HeldMessage, len(h.messages))
+	copy(out, h.messages)
+	return out
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestHeldMessages(t *testing.T) {
+	c := &Connection{blocksend: make(chan *message, 4)}
+	c.user = &User{id: 1, nick: "testnick"}
+	c.user.assembleSimplifiedUser()
+
+	for i := 0; i < 2; i++ {
+		out := c.getEventDataOut()
+		out.Data = "held message"
+		held.hold(c, out, "test")
+	}
+
+	if e := <-c.blocksend; e.event != "ERR" || e.data != "held" {
+		t.Errorf("author should be told the message is held, got %+v", e)
+	}
+
+	list := held.list()
+	if len(list) != 2 {
+		t.Fatalf("expected 2 held messages, got %v", len(list))
+	}
+	if list[0].Message.SimplifiedUser == c.user.simplified {
+		t.Error("held message should keep its own copy of the user")
+	}
+
+	if m := held.take(list[0].Id); m == nil || m.Message.Data != "held message" || m.userid != c.user.id {
+		t.Error("unable to take held message", m)
+	}
+	if m := held.take(list[0].Id); m != nil {
+		t.Error("held message should only be taken once")
+	}
+	if len(held.list()) != 1 {
+		t.Error("taken message should be removed from the queue")
+	}
+}
@@ -1,35 +1,80 @@
 package main
 
 import (
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Hub struct {
 	connections map[*Connection]bool
 	broadcast   chan *message
-	privmsg     chan *PrivmsgOut
+	modmsg      chan *message
 	register    chan *Connection
 	unregister  chan *Connection
-	bans        chan Userid
-	ipbans      chan string
+	bans        chan *userBan
+	ipbans      chan *ipBan
+	kicks       chan *kickUser
 	getips      chan useridips
 	users       map[Userid]*User
 	refreshuser chan Userid
 }
 
+type userBan struct {
+	userid Userid
+	info   *BanInfo
+}
+
+type ipBan struct {
+	ip   string // a single ip or a range in cidr notation
+	info *BanInfo
+}
+
+func (b *ipBan) matches(ip string) bool {
+	if b.ip == ip {
+		return true
+	}
+	if n := parseRange(b.ip); n != nil {
+		parsed := net.ParseIP(ip)
+		return parsed != nil && n.Contains(parsed)
+	}
+	return false
+}
+
+type kickUser struct {
+	userid Userid
+	reason string
+}
+
 type useridips struct {
 	userid Userid
 	c      chan []string
 }
 
+// droppedmessageid is the newest event dropped from the full history cache,
+// protected by MSGLOCK
+var droppedmessageid int64
+
+// lastmessageid is the id of the last event handed out by nextMessageID,
+// reservedmessageid the high-water mark persisted in the database
+var (
+	lastmessageid     int64
+	reservedmessageid int64
+	reservelock       sync.Mutex
+	sendlock          sync.Mutex // held while an id is taken and its events queued
+)
+
 var hub = Hub{
 	connections: make(map[*Connection]bool),
 	broadcast:   make(chan *message, BROADCASTCHANNELSIZE),
-	privmsg:     make(chan *PrivmsgOut, BROADCASTCHANNELSIZE),
+	modmsg:      make(chan *message, BROADCASTCHANNELSIZE),
 	register:    make(chan *Connection, 256),
 	unregister:  make(chan *Connection),
-	bans:        make(chan Userid, 4),
-	ipbans:      make(chan string, 4),
+	bans:        make(chan *userBan, 4),
+	ipbans:      make(chan *ipBan, 4),
+	kicks:       make(chan *kickUser, 4),
 	getips:      make(chan useridips),
 	users:       make(map[Userid]*User),
 	refreshuser: make(chan Userid, 4),
@@ -42,6 +87,11 @@ func (hub *Hub) run() {
 		select {
 		case c := <-hub.register:
 			hub.connections[c] = true
+			// the snapshot is taken in order with the broadcasts, so nothing is
+			// missed or sent twice between the replay and the live events
+			if c.replay != nil {
+				c.replay <- getReplay(c.resumeid)
+			}
 		case c := <-hub.unregister:
 			delete(hub.connections, c)
 		case userid := <-hub.refreshuser:
@@ -50,17 +100,23 @@ func (hub *Hub) run() {
 					go c.Refresh()
 				}
 			}
-		case userid := <-hub.bans:
+		case b := <-hub.bans:
 			for c, _ := range hub.connections {
-				if c.user != nil && c.user.id == userid {
-					go c.Banned()
+				if c.user != nil && c.user.id == b.userid {
+					go c.Banned(b.info)
 				}
 			}
-		case stringip := <-hub.ipbans:
+		case b := <-hub.ipbans:
 			for c := range hub.connections {
-				if c.ip == stringip {
-					DP("Found connection to ban with ip", stringip, "user", c.user)
-					go c.Banned()
+				if b.matches(c.ip) {
+					DP("Found connection to ban with ip", b.ip, "user", c.user)
+					go c.Banned(b.info)
+				}
+			}
+		case k := <-hub.kicks:
+			for c := range hub.connections {
+				if c.user != nil && c.user.id == k.userid {
+					go c.Kicked(k.reason)
 				}
 			}
 		case d := <-hub.getips:
@@ -72,9 +128,29 @@ func (hub *Hub) run() {
 			}
 			d.c <- ips
 		case message := <-hub.broadcast:
+			// events for a single user, like private messages, come through here
+			// too so every connection gets the messageids in order
+			if message.userid != 0 {
+				for c := range hub.connections {
+					if c.user != nil && c.user.id == message.userid {
+						if len(c.sendmarshalled) < SENDCHANNELSIZE {
+							c.sendmarshalled <- message
+						}
+					}
+				}
+				break
+			}
+
 			// TODO should be channel, could lock up...
-			// TODO save into state in case of restart??
-			if message.event != "JOIN" && message.event != "QUIT" && message.event != "VIEWERSTATE" {
+			if isHistoryEvent(message.event) {
+				// cleared here so events still queued before the CLEAR are wiped too
+				if message.event == "CLEAR" {
+					clearChatCache(message.id)
+				}
+				// same for the messages of the nick still queued before the PURGE
+				if message.event == "PURGE" {
+					purgeChatEvents(message.target)
+				}
 				cacheChatEvent(message)
 			}
 
@@ -83,11 +159,11 @@ func (hub *Hub) run() {
 					c.sendmarshalled <- message
 				}
 			}
-		case p := <-hub.privmsg:
-			for c, _ := range hub.connections {
-				if c.user != nil && c.user.id == p.targetuid {
+		case m := <-hub.modmsg:
+			for c := range hub.connections {
+				if c.user != nil && c.user.isModerator() {
 					if len(c.sendmarshalled) < SENDCHANNELSIZE {
-						c.sendmarshalled <- &p.message
+						c.sendmarshalled <- m
 					}
 				}
 			}
@@ -105,9 +181,69 @@ func (hub *Hub) run() {
 	}
 }
 
-// TODO redis replacement
+// cachedEvent is a chat event kept in the history, data is the marshalled json
+type cachedEvent struct {
+	id    int64
+	event string
+	nick  string
+	data  []byte
+}
+
 func cacheChatEvent(msg *message) {
-	if len(MSGCACHE) <= 0 {
+	// the history is disabled, nothing would ever be read back
+	if MSGCACHESIZE <= 0 {
+		return
+	}
+
+	data := msg.data.([]byte)
+	db.insertMessage(msg.id, msg.event, msg.nick, data)
+	appendChatCache(&cachedEvent{msg.id, msg.event, msg.nick, data})
+}
+
+// isHistoryEvent checks if the event is kept in the chat history and gets a messageid
+func isHistoryEvent(event string) bool {
+	return event != "JOIN" && event != "QUIT" && event != "VIEWERSTATE"
+}
+
+// queueEvents gives build the next messageid and queues the events it returns,
+// under one lock so the hub gets every event in the order of the messageids
+func queueEvents(build func(id int64) []*message) {
+	sendlock.Lock()
+	defer sendlock.Unlock()
+
+	for _, m := range build(nextMessageID()) {
+		hub.broadcast <- m
+	}
+}
+
+// nextMessageID returns a new monotonic id, ids are reserved in blocks in the
+// database before being handed out so they are never reused after a restart
+func nextMessageID() int64 {
+	id := atomic.AddInt64(&lastmessageid, 1)
+	if id > atomic.LoadInt64(&reservedmessageid) {
+		reserveMessageIDs(id)
+	}
+	return id
+}
+
+func reserveMessageIDs(id int64) {
+	reservelock.Lock()
+	defer reservelock.Unlock()
+
+	if id <= reservedmessageid {
+		return
+	}
+
+	reserved := id + MESSAGEIDBLOCK
+	if err := db.reserveMessageIDs(reserved); err != nil {
+		// better to reserve again on the next id than to hand out unreserved ones
+		return
+	}
+	atomic.StoreInt64(&reservedmessageid, reserved)
+}
+
+func appendChatCache(e *cachedEvent) {
+	if MSGCACHESIZE <= 0 {
 		return
 	}
 
@@ -115,31 +251,145 @@ func cacheChatEvent(msg *message) {
 	defer MSGLOCK.Unlock()
 
 	if len(MSGCACHE) >= MSGCACHESIZE {
+		droppedmessageid = MSGCACHE[0].id
 		MSGCACHE = MSGCACHE[1:]
 	}
 
-	data, err := Pack(msg.event, msg.data.([]byte))
+	MSGCACHE = append(MSGCACHE, e)
+}
+
+// loadChatCache warms the history from the messages persisted before the last restart
+func loadChatCache() {
+	last := db.getLastMessageID()
+	atomic.StoreInt64(&lastmessageid, last)
+	atomic.StoreInt64(&reservedmessageid, last)
+
+	db.getMessages(MSGCACHESIZE, func(id int64, event string, nick string, data []byte) {
+		appendChatCache(&cachedEvent{id, event, nick, data})
+	})
+
+	// older events might have been pruned from the database already
+	MSGLOCK.Lock()
+	if len(MSGCACHE) > 0 && len(MSGCACHE) >= MSGCACHESIZE {
+		droppedmessageid = MSGCACHE[0].id - 1
+	}
+	MSGLOCK.Unlock()
+}
+
+func getCache() []string {
+	MSGLOCK.RLock()
+	defer MSGLOCK.RUnlock()
+
+	out := make([]string, 0, len(MSGCACHE))
+	for _, e := range MSGCACHE {
+		data, err := Pack(e.event, e.data)
+		if err != nil {
+			D("getCache pack error", err)
+			continue
+		}
+		out = append(out, string(data))
+	}
+
+	return out
+}
+
+// getCacheSince returns the cached events newer than the given messageid,
+// complete is false if some of them were already dropped from the cache
+func getCacheSince(id int64) (out []*message, complete bool) {
+	MSGLOCK.RLock()
+	defer MSGLOCK.RUnlock()
+
+	out = []*message{}
+	for _, e := range MSGCACHE {
+		if e.id > id {
+			out = append(out, &message{
+				id:    e.id,
+				event: e.event,
+				data:  e.data,
+			})
+		}
+	}
+
+	return out, MSGCACHESIZE > 0 && id >= droppedmessageid
+}
+
+// getReplay returns the events missed by a client resuming after the given
+// messageid, led by an ERR "historyincomplete" when not all of them are cached
+// anymore, the client has to refetch /api/chat/history then
+func getReplay(id int64) []*message {
+	missed, complete := getCacheSince(id)
+	if complete {
+		return missed
+	}
+
+	data, _ := Marshal("historyincomplete")
+	return append([]*message{{event: "ERR", data: data}}, missed...)
+}
+
+// emitToModerators sends the event only to the connections of moderators
+func (hub *Hub) emitToModerators(event string, data interface{}) {
+	marshalled, err := Marshal(data)
 	if err != nil {
-		D("cacheChatEvent pack error", err)
+		D("emitToModerators marshal error", err)
 		return
 	}
 
-	MSGCACHE = append(MSGCACHE, string(data[:]))
+	hub.modmsg <- &message{
+		event: event,
+		data:  marshalled,
+	}
 }
 
-// TODO
-func getCache() []string {
+// getCachedEvent returns the cached event with the given messageid, or nil
+func getCachedEvent(id int64) *cachedEvent {
 	MSGLOCK.RLock()
 	defer MSGLOCK.RUnlock()
 
-	out := []string{}
-	for _, v := range MSGCACHE {
-		if v != "" {
-			out = append(out, v)
+	for _, e := range MSGCACHE {
+		if e.id == id {
+			return e
 		}
 	}
+	return nil
+}
 
-	return out
+// deleteChatEvent removes the event from the history cache and the messages table
+func deleteChatEvent(id int64) {
+	MSGLOCK.Lock()
+	for i, e := range MSGCACHE {
+		if e.id == id {
+			MSGCACHE = append(MSGCACHE[:i], MSGCACHE[i+1:]...)
+			break
+		}
+	}
+	MSGLOCK.Unlock()
+
+	db.deleteMessage(id)
+}
+
+// purgeChatEvents removes every chat message of the nick from the history
+func purgeChatEvents(nick string) {
+	MSGLOCK.Lock()
+	kept := MSGCACHE[:0]
+	for _, e := range MSGCACHE {
+		if e.event != "MSG" || !strings.EqualFold(e.nick, nick) {
+			kept = append(kept, e)
+		}
+	}
+	MSGCACHE = kept
+	MSGLOCK.Unlock()
+
+	db.purgeMessages(nick)
+}
+
+// clearChatCache empties the history cache and deletes the persisted events
+// older than the messageid of the CLEAR
+func clearChatCache(id int64) {
+	MSGLOCK.Lock()
+	MSGCACHE = MSGCACHE[:0]
+	MSGLOCK.Unlock()
+
+	db.clearMessages(id)
 }
 
 func (hub *Hub) getIPsForUserid(userid Userid) []string {
@@ -159,6 +409,12 @@ func (hub *Hub) canUserSpeak(c *Connection) bool {
 	return false
 }
 
+func (hub *Hub) getSubmode() bool {
+	state.RLock()
+	defer state.RUnlock()
+	return state.submode
+}
+
 func (hub *Hub) toggleSubmode(enabled bool) {
 	state.Lock()
 	defer state.Unlock()
@@ -166,3 +422,61 @@ func (hub *Hub) toggleSubmode(enabled bool) {
 	state.submode = enabled
 	state.save()
 }
+
+// mustSendEmotes checks if the user is limited to emote-only messages
+func (hub *Hub) mustSendEmotes(c *Connection) bool {
+	state.RLock()
+	defer state.RUnlock()
+
+	if !state.emoteonly || c.user.isExempt() {
+		return false
+	}
+	if EMOTEONLYSUBS && c.user.isSubscriber() {
+		return false
+	}
+
+	return true
+}
+
+func (hub *Hub) toggleEmoteonly(enabled bool) {
+	state.Lock()
+	defer state.Unlock()
+
+	state.emoteonly = enabled
+	state.save()
+}
+
+func (hub *Hub) getSlowmode() time.Duration {
+	state.RLock()
+	defer state.RUnlock()
+
+	return state.slowmode
+}
+
+func (hub *Hub) setSlowmode(d time.Duration) {
+	state.Lock()
+	defer state.Unlock()
+
+	state.slowmode = d
+	state.save()
+}
+
+// isAccountTooYoung checks if the account is newer than the minimum account age
+func (hub *Hub) isAccountTooYoung(c *Connection) bool {
+	state.RLock()
+	defer state.RUnlock()
+
+	if state.minage <= 0 || c.user.isSubscriber() {
+		return false
+	}
+
+	return time.Since(c.user.firstlogin) < state.minage
+}
+
+func (hub *Hub) setMinAccountAge(d time.Duration) {
+	state.Lock()
+	defer state.Unlock()
+
+	state.minage = d
+	state.save()
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// setChatCache replaces the history cache for a test, the returned func restores it
+func setChatCache(size int) func() {
+	oldsize, oldcache, olddropped := MSGCACHESIZE, MSGCACHE, droppedmessageid
+	MSGCACHESIZE = size
+	MSGCACHE = make([]*cachedEvent, 0, size)
+	droppedmessageid = 0
+	return func() {
+		MSGCACHESIZE, MSGCACHE, droppedmessageid = oldsize, oldcache, olddropped
+	}
+}
+
+func TestChatCacheSince(t *testing.T) {
+	defer setChatCache(3)()
+
+	for id := int64(1); id <= 5; id++ {
+		appendChatCache(&cachedEvent{id, "MSG", "testnick", []byte(`{}`)})
+	}
+
+	if n := len(getCache()); n != 3 {
+		t.Errorf("cache should be capped at 3 events, has %v", n)
+	}
+
+	missed, complete := getCacheSince(3)
+	if len(missed) != 2 || missed[0].id != 4 || missed[1].id != 5 || !complete {
+		t.Errorf("expected events 4 and 5 to be replayed, got %+v", missed)
+	}
+	if missed, _ := getCacheSince(5); len(missed) != 0 {
+		t.Error("nothing should be replayed for the latest messageid")
+	}
+
+	if _, complete := getCacheSince(1); complete {
+		t.Error("event 2 was dropped from the cache, the replay can not be complete")
+	}
+	if replay := getReplay(1); len(replay) != 4 || replay[0].event != "ERR" {
+		t.Errorf("expected the replay to start with an error, got %+v", replay)
+	}
+}
+
+func TestDeleteChatEvent(t *testing.T) {
+	defer setChatCache(3)()
+
+	for id := int64(1); id <= 3; id++ {
+		appendChatCache(&cachedEvent{id, "MSG", "testnick", []byte(`{}`)})
+	}
+
+	deleteChatEvent(2)
+	if getCachedEvent(2) != nil {
+		t.Error("deleted event should not be in the cache anymore")
+	}
+	if getCachedEvent(1) == nil || getCachedEvent(3) == nil {
+		t.Error("only the deleted event should be removed from the cache")
+	}
+}
+
+func TestPurgeChatEvents(t *testing.T) {
+	defer setChatCache(5)()
+
+	appendChatCache(&cachedEvent{1, "MSG", "spammer", []byte(`{}`)})
+	appendChatCache(&cachedEvent{2, "MSG", "testnick", []byte(`{}`)})
+	appendChatCache(&cachedEvent{3, "MSG", "Spammer", []byte(`{}`)})
+	appendChatCache(&cachedEvent{4, "BAN", "spammer", []byte(`{}`)})
+
+	purgeChatEvents("SPAMMER")
+	if n := len(getCache()); n != 2 {
+		t.Errorf("expected 2 events left after the purge, got %v", n)
+	}
+	if getCachedEvent(2) == nil || getCachedEvent(4) == nil {
+		t.Error("only chat messages by the purged nick should be removed")
+	}
+}
+
+func TestAccountTooYoung(t *testing.T) {
+	c := new(Connection)
+	c.user = &User{}
+	c.user.firstlogin = time.Now().Add(-time.Hour)
+
+	state.minage = 24 * time.Hour
+	defer func() { state.minage = 0 }()
+
+	if !hub.isAccountTooYoung(c) {
+		t.Error("an account from an hour ago should be too young")
+	}
+
+	c.user.setFeatures([]string{"subscriber"})
+	if hub.isAccountTooYoung(c) {
+		t.Error("subscribers should be exempt from the account age check")
+	}
+
+	c.user = &User{}
+	c.user.firstlogin = time.Now().Add(-48 * time.Hour)
+	if hub.isAccountTooYoung(c) {
+		t.Error("an account from two days ago should be old enough")
+	}
+}
+
+func isMessageStored(id int64) bool {
+	db.Lock()
+	defer db.Unlock()
+
+	var n int
+	db.db.QueryRow(`SELECT COUNT(*) FROM messages WHERE id = ?`, id).Scan(&n)
+	return n > 0
+}
+
+func TestMessageRetention(t *testing.T) {
+	ops := []*dbMessageOp{}
+	for id := int64(1001); id <= 1005; id++ {
+		ops = append(ops, &dbMessageOp{kind: MESSAGEINSERT, id: id, event: "MSG", nick: "retention", data: `{}`})
+	}
+	if err := db.writeMessageOps(ops, 3); err != nil {
+		t.Fatal(err)
+	}
+
+	ids := []int64{}
+	db.getMessages(10, func(id int64, event string, nick string, data []byte) {
+		ids = append(ids, id)
+	})
+	if len(ids) != 3 || ids[0] != 1003 || ids[2] != 1005 {
+		t.Errorf("only the last 3 messages should be kept, got %v", ids)
+	}
+}
+
+func TestMessageIDsReserved(t *testing.T) {
+	// ids handed out but never stored must not be reused after a restart
+	id := nextMessageID()
+	if last := db.getLastMessageID(); last < id {
+		t.Errorf("id %v should be reserved in the database, last is %v", id, last)
+	}
+}
+
+func TestMessageDeleteAfterInsert(t *testing.T) {
+	err := db.writeMessageOps([]*dbMessageOp{
+		{kind: MESSAGEINSERT, id: 2001, event: "MSG", nick: "deleted", data: `{}`},
+		{kind: MESSAGEDELETE, id: 2001},
+	}, 150)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if isMessageStored(2001) {
+		t.Error("a message deleted right after its insert should not be stored")
+	}
+}
+
+func TestMessagePurgeAfterInsert(t *testing.T) {
+	err := db.writeMessageOps([]*dbMessageOp{
+		{kind: MESSAGEINSERT, id: 3001, event: "MSG", nick: "purged", data: `{}`},
+		{kind: MESSAGEINSERT, id: 3002, event: "MUTE", nick: "Purged", data: `{}`},
+		{kind: MESSAGEPURGE, nick: "PURGED"},
+	}, 150)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if isMessageStored(3001) {
+		t.Error("a message purged right after its insert should not be stored")
+	}
+	if !isMessageStored(3002) {
+		t.Error("only chat messages of the nick should be purged")
+	}
+}
+
+func TestEmoteonlyExempt(t *testing.T) {
+	c := new(Connection)
+	c.user = &User{}
+
+	state.emoteonly = true
+	defer func() { state.emoteonly = false }()
+
+	if !hub.mustSendEmotes(c) {
+		t.Error("regular users should be limited to emotes")
+	}
+
+	c.user.setFeatures([]string{"subscriber"})
+	if !hub.mustSendEmotes(c) {
+		t.Error("subscribers should only be exempt with emoteonlyexemptsubscribers")
+	}
+
+	c.user.setFeatures([]string{"moderator"})
+	if hub.mustSendEmotes(c) {
+		t.Error("moderators should always be exempt from emote-only mode")
+	}
+}
+
+func TestQueuedEventsInOrder(t *testing.T) {
+	for len(hub.broadcast) > 0 {
+		<-hub.broadcast
+	}
+
+	done := make(chan bool)
+	for i := 0; i < 4; i++ {
+		go func() {
+			for j := 0; j < 25; j++ {
+				broadcastFrom(nil, "BROADCAST", &EventDataOut{Data: "order"})
+			}
+			done <- true
+		}()
+	}
+
+	var last int64
+	for received := 0; received < 100; received++ {
+		m := <-hub.broadcast
+		if m.id <= last {
+			t.Fatalf("messageid %v was queued after %v", m.id, last)
+		}
+		last = m.id
+	}
+	for i := 0; i < 4; i++ {
+		<-done
+	}
+}
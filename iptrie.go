@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net"
+	"time"
+)
+
+// ipTrie is a binary trie over the bits of the addresses, ipv4 addresses are
+// stored in their ipv6 mapped form, a banned range is kept in the node at the
+// end of its prefix so a lookup is at most 128 steps no matter how many there are
+type ipTrie struct {
+	root ipTrieNode
+}
+
+type ipTrieNode struct {
+	children [2]*ipTrieNode
+	network  string // the range in cidr notation, empty if not banned
+	expire   time.Time
+}
+
+// ipTrieKey returns the 16 byte form of the network and its prefix length in it
+func ipTrieKey(n *net.IPNet) (net.IP, int) {
+	ones, bits := n.Mask.Size()
+	if bits == 8*net.IPv4len {
+		ones += 8 * (net.IPv6len - net.IPv4len)
+	}
+	return n.IP.To16(), ones
+}
+
+func ipBit(ip net.IP, i int) int {
+	return int(ip[i/8]>>uint(7-i%8)) & 1
+}
+
+func (t *ipTrie) find(n *net.IPNet, create bool) *ipTrieNode {
+	ip, ones := ipTrieKey(n)
+	if ip == nil {
+		return nil
+	}
+
+	node := &t.root
+	for i := 0; i < ones; i++ {
+		b := ipBit(ip, i)
+		if node.children[b] == nil {
+			if !create {
+				return nil
+			}
+			node.children[b] = &ipTrieNode{}
+		}
+		node = node.children[b]
+	}
+	return node
+}
+
+func (t *ipTrie) insert(n *net.IPNet, expire time.Time) {
+	if node := t.find(n, true); node != nil {
+		node.network = n.String()
+		node.expire = expire
+	}
+}
+
+func (t *ipTrie) get(n *net.IPNet) (time.Time, bool) {
+	node := t.find(n, false)
+	if node == nil || node.network == "" {
+		return time.Time{}, false
+	}
+	return node.expire, true
+}
+
+// remove unbans the range, the empty nodes are left in place because
+// ranges tend to be banned again
+func (t *ipTrie) remove(n *net.IPNet) {
+	if node := t.find(n, false); node != nil {
+		node.network = ""
+		node.expire = time.Time{}
+	}
+}
+
+// lookup returns the first range containing the ip that is still banned
+func (t *ipTrie) lookup(ip net.IP) (string, time.Time, bool) {
+	ip = ip.To16()
+	if ip == nil {
+		return "", time.Time{}, false
+	}
+
+	node := &t.root
+	for i := 0; node != nil; i++ {
+		if node.network != "" && !isExpiredUTC(node.expire) {
+			return node.network, node.expire, true
+		}
+		if i == 8*net.IPv6len {
+			break
+		}
+		node = node.children[ipBit(ip, i)]
+	}
+	return "", time.Time{}, false
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestIPTrie(t *testing.T) {
+	trie := ipTrie{}
+	timeinfuture := time.Now().UTC().Add(time.Hour)
+	_, v4, _ := net.ParseCIDR("10.1.2.0/24")
+	_, v6, _ := net.ParseCIDR("2001:db8:1234::/48")
+	trie.insert(v4, timeinfuture)
+	trie.insert(v6, timeinfuture)
+
+	for _, ip := range []string{"10.1.2.3", "10.1.2.255", "2001:db8:1234:5678::1"} {
+		if _, _, ok := trie.lookup(net.ParseIP(ip)); !ok {
+			t.Errorf("%s should be in a banned range", ip)
+		}
+	}
+	for _, ip := range []string{"10.1.3.3", "2001:db8:1235::1", "::ffff:10.1.4.1"} {
+		if _, _, ok := trie.lookup(net.ParseIP(ip)); ok {
+			t.Errorf("%s should not be in a banned range", ip)
+		}
+	}
+
+	if network, _, _ := trie.lookup(net.ParseIP("10.1.2.3")); network != "10.1.2.0/24" {
+		t.Errorf("expected the matching range, got %s", network)
+	}
+
+	trie.remove(v4)
+	if _, _, ok := trie.lookup(net.ParseIP("10.1.2.3")); ok {
+		t.Error("the range should be unbanned")
+	}
+
+	trie.insert(v4, time.Now().UTC().Add(-time.Hour))
+	if _, _, ok := trie.lookup(net.ParseIP("10.1.2.3")); ok {
+		t.Error("an expired range should not match")
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	LINKALLOW = "allow"
+	LINKBLOCK = "block"
+)
+
+var ErrInvalidLinkPolicy = errors.New("invalid link policy")
+
+type LinkPolicy struct {
+	lists map[string]string // domain -> LINKALLOW or LINKBLOCK
+	sync.RWMutex
+}
+
+type LinkPolicyOut struct {
+	Allowlist bool     `json:"allowlist"`
+	Subonly   bool     `json:"subonly"`
+	Allowed   []string `json:"allowed"`
+	Blocked   []string `json:"blocked"`
+}
+
+var linkpolicy = LinkPolicy{lists: make(map[string]string)}
+
+func (p *LinkPolicy) load() {
+	lists := make(map[string]string)
+	db.getLinkDomains(func(domain string, list string) {
+		lists[domain] = list
+	})
+
+	p.Lock()
+	defer p.Unlock()
+	p.lists = lists
+}
+
+// apply runs a policy change, action is one of block, unblock, allow, disallow
+// with a domain as the argument, or allowlist, subonly with on/off
+func (p *LinkPolicy) apply(action string, arg string) error {
+	switch action {
+	case "allowlist", "subonly":
+		if arg != "on" && arg != "off" {
+			return ErrInvalidLinkPolicy
+		}
+		p.toggleMode(action, arg == "on")
+		return nil
+	}
+
+	domain := strings.TrimPrefix(strings.ToLower(strings.TrimSpace(arg)), "www.")
+	if domain == "" || strings.ContainsAny(domain, "/: ") {
+		return ErrInvalidLinkPolicy
+	}
+
+	var err error
+	switch action {
+	case "block":
+		err = db.setLinkDomain(domain, LINKBLOCK)
+	case "allow":
+		err = db.setLinkDomain(domain, LINKALLOW)
+	case "unblock", "disallow":
+		err = db.deleteLinkDomain(domain)
+	default:
+		return ErrInvalidLinkPolicy
+	}
+	if err != nil {
+		return err
+	}
+	p.load()
+	return nil
+}
+
+func (p *LinkPolicy) toggleMode(mode string, enabled bool) {
+	state.Lock()
+	defer state.Unlock()
+
+	if mode == "allowlist" {
+		state.linkallowlist = enabled
+	} else {
+		state.linksubonly = enabled
+	}
+	state.save()
+}
+
+func (p *LinkPolicy) dump() *LinkPolicyOut {
+	out := &LinkPolicyOut{Allowed: []string{}, Blocked: []string{}}
+
+	state.RLock()
+	out.Allowlist = state.linkallowlist
+	out.Subonly = state.linksubonly
+	state.RUnlock()
+
+	p.RLock()
+	defer p.RUnlock()
+	for domain, list := range p.lists {
+		if list == LINKALLOW {
+			out.Allowed = append(out.Allowed, domain)
+		} else {
+			out.Blocked = append(out.Blocked, domain)
+		}
+	}
+	sort.Strings(out.Allowed)
+	sort.Strings(out.Blocked)
+	return out
+}
+
+// lookup returns the list of the host or of its closest listed parent domain
+func (p *LinkPolicy) lookup(host string) string {
+	p.RLock()
+	defer p.RUnlock()
+
+	for {
+		if list, ok := p.lists[host]; ok {
+			return list
+		}
+		i := strings.IndexByte(host, '.')
+		if i == -1 {
+			return ""
+		}
+		host = host[i+1:]
+	}
+}
+
+// allows checks if the user may post all of the links
+func (p *LinkPolicy) allows(u *User, links []*Link) bool {
+	if len(links) == 0 || u.isModerator() {
+		return true
+	}
+
+	state.RLock()
+	allowlist, subonly := state.linkallowlist, state.linksubonly
+	state.RUnlock()
+
+	if subonly && !u.isSubscriber() {
+		return false
+	}
+
+	for _, l := range links {
+		switch p.lookup(linkHost(l.URL)) {
+		case LINKBLOCK:
+			return false
+		case LINKALLOW:
+		default:
+			if allowlist {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// linkHost returns the lowercase host of a link found by xurls.Relaxed,
+// which does not need a scheme
+func linkHost(link string) string {
+	if !strings.Contains(link, "://") {
+		link = "http://" + link
+	}
+	u, err := url.Parse(link)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestLinkPolicy(t *testing.T) {
+	if h := linkHost("WWW.Example.com/some/path"); h != "www.example.com" {
+		t.Error("expected host www.example.com, got", h)
+	}
+	if h := linkHost("https://sub.example.org:8080/x"); h != "sub.example.org" {
+		t.Error("expected host sub.example.org, got", h)
+	}
+
+	if err := linkpolicy.apply("block", "www.bad.com"); err != nil {
+		t.Fatal("unable to block domain", err)
+	}
+	if err := linkpolicy.apply("allow", "good.com"); err != nil {
+		t.Fatal("unable to allow domain", err)
+	}
+	defer linkpolicy.apply("unblock", "bad.com")
+	defer linkpolicy.apply("disallow", "good.com")
+
+	u := &User{}
+	links := func(urls ...string) []*Link {
+		out := []*Link{}
+		for _, url := range urls {
+			out = append(out, &Link{URL: url})
+		}
+		return out
+	}
+
+	if linkpolicy.allows(u, links("http://cdn.bad.com/x.png")) {
+		t.Error("subdomains of blocked domains should not be allowed")
+	}
+	if !linkpolicy.allows(u, links("other.com", "good.com")) {
+		t.Error("unlisted domains should be allowed when not in allowlist mode")
+	}
+
+	state.linkallowlist = true
+	defer func() { state.linkallowlist = false }()
+	if linkpolicy.allows(u, links("other.com")) {
+		t.Error("unlisted domains should not be allowed in allowlist mode")
+	}
+	if !linkpolicy.allows(u, links("https://www.good.com/")) {
+		t.Error("allowed domains should be allowed in allowlist mode")
+	}
+
+	state.linksubonly = true
+	defer func() { state.linksubonly = false }()
+	if linkpolicy.allows(u, links("good.com")) {
+		t.Error("only subscribers should be able to post links")
+	}
+	u.setFeatures([]string{"subscriber"})
+	if !linkpolicy.allows(u, links("good.com")) {
+		t.Error("subscribers should be able to post allowed links")
+	}
+}
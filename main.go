@@ -26,12 +26,22 @@ import (
 )
 
 type State struct {
-	mutes   map[Userid]time.Time
-	submode bool
+	mutes       map[Userid]time.Time
+	legacymutes map[Userid]time.Time // from an older states file, not in the database yet
+	submode     bool
+	slowmode    time.Duration
+	emoteonly   bool
+	minage      time.Duration // minimum account age needed to chat
+	// link policy modes, the domain lists are in the database
+	linkallowlist bool
+	linksubonly   bool
 	sync.RWMutex
 }
 
-var state = &State{mutes: make(map[Userid]time.Time)}
+var state = &State{
+	mutes:       make(map[Userid]time.Time),
+	legacymutes: make(map[Userid]time.Time),
+}
 
 const (
 	WRITETIMEOUT         = 10 * time.Second
@@ -43,6 +53,11 @@ const (
 	BROADCASTCHANNELSIZE = 256
 	DEFAULTBANDURATION   = time.Hour
 	DEFAULTMUTEDURATION  = 10 * time.Minute
+	MAXSLOWMODEDURATION  = time.Hour
+	MAXACCOUNTAGE        = 30 * 24 * time.Hour
+	MINIPV4BANPREFIX     = 16 // the largest ranges that can be banned at once
+	MINIPV6BANPREFIX     = 32
+	MESSAGEIDBLOCK       = 1000 // message ids reserved in the database at once
 )
 
 var (
@@ -54,11 +69,21 @@ var (
 	APIUSERID        = ""
 	USERNAMEAPI      = "http://localhost:8076/api/username/"
 	VIEWERSTATEAPI   = "http://localhost:8076/api/admin/viewer-state"
-	MSGCACHE         = []string{} // TODO redis replacement...
+	MSGCACHE         = []*cachedEvent{}
 	MSGCACHESIZE     = 150
 	MSGLOCK          sync.RWMutex
 	RARECHANCE       = 0.00001
 	EMOTEMANIFEST    = "http://localhost:18078/emote-manifest.json"
+	EMOTEONLYSUBS    = false // subscribers may send text in emote-only mode, exempt users always can
+	SPAMWINDOW       = 30 * time.Second
+	SPAMTHRESHOLD    = 5 // distinct accounts posting the same text within SPAMWINDOW
+	// messages at least this similar to one of the last few of a user are duplicates
+	DUPLICATESIMILARITY = 0.9
+	// prefix lengths the ips are masked to, ipv6 users usually get a whole /64
+	IPV4MASK = 32
+	IPV6MASK = 64
+	// only the ips a user logged in from this recently are banned with them
+	IPBANHISTORY = 30 * 24 * time.Hour
 )
 
 func main() {
@@ -79,7 +104,15 @@ func main() {
 		nc.AddOption("default", "messagecachesize", "150")
 		nc.AddOption("default", "rarechance", strconv.FormatFloat(RARECHANCE, 'f', -1, 64))
 		nc.AddOption("default", "emotemanifest", EMOTEMANIFEST)
+		nc.AddOption("default", "emoteonlyexemptsubscribers", "false")
+		nc.AddOption("default", "spamwindow", fmt.Sprintf("%d", SPAMWINDOW))
+		nc.AddOption("default", "spamthreshold", strconv.Itoa(SPAMTHRESHOLD))
+		nc.AddOption("default", "duplicatesimilarity", strconv.FormatFloat(DUPLICATESIMILARITY, 'f', -1, 64))
+		nc.AddOption("default", "ipv4mask", strconv.Itoa(IPV4MASK))
+		nc.AddOption("default", "ipv6mask", strconv.Itoa(IPV6MASK))
+		nc.AddOption("default", "ipbanhistory", fmt.Sprintf("%d", IPBANHISTORY))
 		nc.AddOption("default", "initdb", "false")
+		addAutomodOptions(nc)
 
 		if err = nc.WriteConfigFile("settings.cfg", 0644, "ChatBackend"); err != nil {
 			log.Fatal("Unable to create settings.cfg: ", err)
@@ -106,6 +139,26 @@ func main() {
 	msgcachesize, _ := c.GetInt64("default", "messagecachesize")
 	RARECHANCE, _ = c.GetFloat("default", "rarechance")
 	EMOTEMANIFEST, _ = c.GetString("default", "emotemanifest")
+	EMOTEONLYSUBS, _ = c.GetBool("default", "emoteonlyexemptsubscribers")
+	if spamwindow, err := c.GetInt64("default", "spamwindow"); err == nil {
+		SPAMWINDOW = time.Duration(spamwindow)
+	}
+	if spamthreshold, err := c.GetInt64("default", "spamthreshold"); err == nil {
+		SPAMTHRESHOLD = int(spamthreshold)
+	}
+	if similarity, err := c.GetFloat("default", "duplicatesimilarity"); err == nil {
+		DUPLICATESIMILARITY = similarity
+	}
+	if mask, err := c.GetInt64("default", "ipv4mask"); err == nil && mask > 0 && mask <= 32 {
+		IPV4MASK = int(mask)
+	}
+	if mask, err := c.GetInt64("default", "ipv6mask"); err == nil && mask > 0 && mask <= 128 {
+		IPV6MASK = int(mask)
+	}
+	if history, err := c.GetInt64("default", "ipbanhistory"); err == nil && history >= 0 {
+		IPBANHISTORY = time.Duration(history)
+	}
+	loadAutomodOptions(c)
 
 	if JWTSECRET == "" {
 		JWTSECRET = "PepoThink"
@@ -114,7 +167,7 @@ func main() {
 	if msgcachesize >= 0 {
 		MSGCACHESIZE = int(msgcachesize)
 	}
-	MSGCACHE = make([]string, MSGCACHESIZE)
+	MSGCACHE = make([]*cachedEvent, 0, MSGCACHESIZE)
 
 	if processes <= 0 {
 		processes = int64(runtime.NumCPU())
@@ -123,10 +176,11 @@ func main() {
 
 	state.load()
 	initDatabase(dbfile, initdb)
+	loadChatCache()
 	initEntities()
 
 	go hub.run()
-	go bans.run()
+	go expirations.run()
 	go viewerStates.run()
 
 	var checkOrigin func(r *http.Request) bool
@@ -196,6 +250,17 @@ func main() {
 		}
 	})
 
+	http.HandleFunc("/api/chat/me/ban", handleMeBan)
+	http.HandleFunc("/api/chat/admin/filters", handleAdminFilters)
+	http.HandleFunc("/api/chat/admin/links", handleAdminLinks)
+	http.HandleFunc("/api/chat/admin/automod", handleAdminAutomod)
+	http.HandleFunc("/api/chat/admin/held", handleAdminHeld)
+	http.HandleFunc("/api/chat/admin/reports", handleAdminReports)
+	http.HandleFunc("/api/chat/admin/audit", handleAdminAudit)
+	http.HandleFunc("/api/chat/admin/bans", handleAdminBans)
+	http.HandleFunc("/api/chat/admin/mutes", handleAdminMutes)
+	http.HandleFunc("/api/chat/admin/submode", handleAdminSubmode)
+
 	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "GET" {
 			http.Error(w, "Method not allowed", 405)
@@ -207,15 +272,21 @@ func main() {
 			return
 		}
 
-		user, banned, ip := getUserFromWebRequest(r)
+		user, ban, ip := getUserFromWebRequest(r)
 
-		if banned {
+		if ban != nil {
 			ws.SetWriteDeadline(time.Now().Add(WRITETIMEOUT))
-			ws.WriteMessage(websocket.TextMessage, []byte(`ERR "banned"`))
+			if data, err := packError(ban); err == nil {
+				ws.WriteMessage(websocket.TextMessage, data)
+			}
 			return
 		}
 
-		newConnection(ws, user, ip)
+		// clients reconnecting with the last messageid they saw get the missed events replayed,
+		// an ERR "historyincomplete" first tells them to refetch the history
+		since, _ := strconv.ParseInt(r.URL.Query().Get("since"), 10, 64)
+
+		newConnection(ws, user, ip, since)
 	})
 
 	fmt.Printf("Using %v threads, and listening on: %v\n", processes, addr)
@@ -225,12 +296,17 @@ func main() {
 }
 
 func getMaskedIP(s string) string {
-	ipv6mask := net.CIDRMask(64, 128)
 	ip := net.ParseIP(s)
-	if ip.To4() == nil {
-		return ip.Mask(ipv6mask).String()
+	if ip == nil {
+		return s
+	}
+	if v4 := ip.To4(); v4 != nil {
+		if IPV4MASK >= 32 {
+			return s
+		}
+		return v4.Mask(net.CIDRMask(IPV4MASK, 32)).String()
 	}
-	return s
+	return ip.Mask(net.CIDRMask(IPV6MASK, 128)).String()
 }
 
 func unixMilliTime() int64 {
@@ -261,7 +337,9 @@ func (s *State) load() {
 	}
 	mb := bytes.NewBuffer(b)
 	dec := gob.NewDecoder(mb)
-	err = dec.Decode(&s.mutes)
+	// mutes are in the database now, older states files still have them and
+	// they are migrated by mutes.loadActive
+	err = dec.Decode(&s.legacymutes)
 	if err != nil {
 		D("Error decoding mutes from states file", err)
 	}
@@ -269,13 +347,35 @@ func (s *State) load() {
 	if err != nil {
 		D("Error decoding submode from states file", err)
 	}
+	err = dec.Decode(&s.slowmode)
+	if err != nil {
+		D("Error decoding slowmode from states file", err)
+	}
+	err = dec.Decode(&s.emoteonly)
+	if err != nil {
+		D("Error decoding emoteonly from states file", err)
+	}
+	err = dec.Decode(&s.minage)
+	if err != nil {
+		D("Error decoding minage from states file", err)
+	}
+	err = dec.Decode(&s.linkallowlist)
+	if err != nil {
+		D("Error decoding linkallowlist from states file", err)
+	}
+	err = dec.Decode(&s.linksubonly)
+	if err != nil {
+		D("Error decoding linksubonly from states file", err)
+	}
 }
 
 // expects to be called with locks held
 func (s *State) save() {
 	mb := new(bytes.Buffer)
 	enc := gob.NewEncoder(mb)
-	err := enc.Encode(&s.mutes)
+	// the mutes are kept in the database, only the ones that could not be
+	// migrated yet stay in the file, which keeps its layout
+	err := enc.Encode(s.legacymutes)
 	if err != nil {
 		D("Error encoding mutes:", err)
 	}
@@ -283,6 +383,26 @@ func (s *State) save() {
 	if err != nil {
 		D("Error encoding submode:", err)
 	}
+	err = enc.Encode(&s.slowmode)
+	if err != nil {
+		D("Error encoding slowmode:", err)
+	}
+	err = enc.Encode(&s.emoteonly)
+	if err != nil {
+		D("Error encoding emoteonly:", err)
+	}
+	err = enc.Encode(&s.minage)
+	if err != nil {
+		D("Error encoding minage:", err)
+	}
+	err = enc.Encode(&s.linkallowlist)
+	if err != nil {
+		D("Error encoding linkallowlist:", err)
+	}
+	err = enc.Encode(&s.linksubonly)
+	if err != nil {
+		D("Error encoding linksubonly:", err)
+	}
 
 	err = ioutil.WriteFile(".state.dc", mb.Bytes(), 0600)
 	if err != nil {
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// The moderation actions are shared by the chat commands and the admin api so
+// that both take effect, get audited and get broadcast the same way, the errors
+// are the identifiers sent to the clients
+
+var (
+	errProtocol     = errors.New("protocolerror")
+	errNoPermission = errors.New("nopermission")
+	errNotFound     = errors.New("notfound")
+	errInvalidMsg   = errors.New("invalidmsg")
+	errNeedReason   = errors.New("needbanreason")
+)
+
+// canModerate returns whether the user may moderate the nick, and its userid
+func canModerate(u *User, nick string) (bool, Userid) {
+	if u == nil || utf8.RuneCountInString(nick) == 0 {
+		return false, 0
+	}
+
+	uid, protected := usertools.getUseridForNick(nick)
+	if uid == 0 || u.id == uid || protected {
+		return false, uid
+	}
+
+	return true, uid
+}
+
+func newEventDataOut(u *User) *EventDataOut {
+	out := &EventDataOut{
+		Timestamp: unixMilliTime(),
+	}
+	if u != nil {
+		out.SimplifiedUser = u.simplified
+	}
+	return out
+}
+
+// broadcastFrom sends the event of the user to everyone, a nil user is for events
+// not coming from a connection, like an automatic mute or an approved held
+// message, whose data must then not be shared with a connected user
+func broadcastFrom(u *User, event string, data *EventDataOut) {
+	build := func(id int64) []*message {
+		data.Messageid = id
+
+		var nick string
+		if u != nil {
+			u.RLock()
+		}
+		marshalled, _ := Marshal(data)
+		if data.SimplifiedUser != nil {
+			nick = data.Nick
+		}
+		if u != nil {
+			u.RUnlock()
+		}
+
+		var target string
+		if event == "PURGE" {
+			target = data.Data
+		}
+
+		return []*message{{
+			id:     id,
+			nick:   nick,
+			target: target,
+			event:  event,
+			data:   marshalled,
+		}}
+	}
+
+	if !isHistoryEvent(event) {
+		hub.broadcast <- build(0)[0]
+		return
+	}
+	queueEvents(build)
+}
+
+func modMute(u *User, nick string, duration int64, reason string, purge bool) error {
+	ok, uid := canModerate(u, nick)
+	if !ok || uid == 0 {
+		return errNoPermission
+	}
+
+	if duration == 0 {
+		duration = int64(DEFAULTMUTEDURATION)
+	}
+
+	if duration < 0 || time.Duration(duration) > 7*24*time.Hour {
+		return errProtocol // too long mute
+	}
+
+	reason = strings.TrimSpace(reason)
+	if !utf8.ValidString(reason) {
+		return errInvalidMsg
+	}
+
+	mutes.muteUserid(u.id, uid, duration, reason)
+	audit(u.id, "MUTE", uid, nick, map[string]int64{"duration": duration}, reason)
+	out := newEventDataOut(u)
+	out.Data = nick
+	out.Targetuserid = uid
+	broadcastFrom(u, "MUTE", out)
+
+	if purge {
+		modPurge(u, nick, uid)
+	}
+	return nil
+}
+
+func modUnmute(u *User, nick string) error {
+	if utf8.RuneCountInString(nick) == 0 {
+		return errProtocol
+	}
+
+	uid, _ := usertools.getUseridForNick(nick)
+	if uid == 0 {
+		return errNotFound
+	}
+
+	mutes.unmuteUserid(uid)
+	audit(u.id, "UNMUTE", uid, nick, nil, "")
+	out := newEventDataOut(u)
+	out.Data = nick
+	out.Targetuserid = uid
+	broadcastFrom(u, "UNMUTE", out)
+	return nil
+}
+
+func modBan(u *User, ban *BanIn) error {
+	ok, uid := canModerate(u, ban.Nick)
+	if uid == 0 {
+		return errNotFound
+	} else if !ok {
+		return errNoPermission
+	}
+
+	reason := strings.TrimSpace(ban.Reason)
+	if utf8.RuneCountInString(reason) == 0 || !utf8.ValidString(reason) {
+		return errNeedReason
+	}
+
+	if ban.Duration == 0 {
+		ban.Duration = int64(DEFAULTBANDURATION)
+	}
+
+	if (ban.IPv4Prefix != 0 && (ban.IPv4Prefix < MINIPV4BANPREFIX || ban.IPv4Prefix > 32)) ||
+		(ban.IPv6Prefix != 0 && (ban.IPv6Prefix < MINIPV6BANPREFIX || ban.IPv6Prefix > 128)) {
+		return errProtocol
+	}
+
+	bans.banUser(u.id, uid, ban)
+	audit(u.id, "BAN", uid, ban.Nick, map[string]interface{}{
+		"duration":    ban.Duration,
+		"ispermanent": ban.Ispermanent,
+		"banip":       ban.BanIP,
+		"ipv4prefix":  ban.IPv4Prefix,
+		"ipv6prefix":  ban.IPv6Prefix,
+	}, reason)
+	out := newEventDataOut(u)
+	out.Data = ban.Nick
+	out.Targetuserid = uid
+	broadcastFrom(u, "BAN", out)
+
+	if ban.Purge {
+		modPurge(u, ban.Nick, uid)
+	}
+	return nil
+}
+
+func modUnban(u *User, nick string) error {
+	uid, _ := usertools.getUseridForNick(nick)
+	if uid == 0 {
+		return errNotFound
+	}
+
+	bans.unbanUserid(uid)
+	mutes.unmuteUserid(uid)
+	audit(u.id, "UNBAN", uid, nick, nil, "")
+	out := newEventDataOut(u)
+	out.Data = nick
+	out.Targetuserid = uid
+	broadcastFrom(u, "UNBAN", out)
+	return nil
+}
+
+// modPurge drops the messages of the nick from the history and tells clients to hide them
+func modPurge(u *User, nick string, uid Userid) {
+	audit(u.id, "PURGE", uid, nick, nil, "")
+	out := newEventDataOut(u)
+	out.Data = nick
+	out.Targetuserid = uid
+	broadcastFrom(u, "PURGE", out)
+}
+
+// modSubonly turns the submode on or off
+func modSubonly(u *User, mode string) error {
+	switch mode {
+	case "on":
+		hub.toggleSubmode(true)
+	case "off":
+		hub.toggleSubmode(false)
+	default:
+		return errProtocol
+	}
+
+	audit(u.id, "SUBONLY", 0, "", map[string]string{"data": mode}, "")
+	out := newEventDataOut(u)
+	out.Data = mode
+	broadcastFrom(u, "SUBONLY", out)
+	return nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestModMute(t *testing.T) {
+	db.newUser("moderation-test-uuid", "modtarget", "10.0.0.3")
+	uid, _ := db.getUser("modtarget")
+	defer delete(state.mutes, uid)
+	for len(hub.broadcast) > 0 {
+		<-hub.broadcast
+	}
+
+	mod := &User{id: 61, nick: "moderator"}
+	mod.featureSet(ISMODERATOR)
+	mod.assembleSimplifiedUser()
+
+	if err := modMute(mod, "moderator", 0, "", false); err != errNoPermission {
+		t.Errorf("muting yourself should not be allowed, got %v", err)
+	}
+	if err := modMute(mod, "modtarget", int64(8*24*time.Hour), "", false); err != errProtocol {
+		t.Errorf("too long mutes should be rejected, got %v", err)
+	}
+
+	if err := modMute(mod, "modtarget", 0, "being rude", true); err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	if _, ok := state.mutes[uid]; !ok {
+		t.Error("the target should be muted")
+	}
+	if len(hub.broadcast) != 2 {
+		t.Fatalf("expected a MUTE and a PURGE event, got %d events", len(hub.broadcast))
+	}
+	if m := <-hub.broadcast; m.event != "MUTE" || m.nick != "moderator" {
+		t.Errorf("expected a MUTE from the moderator, got %+v", m)
+	}
+	if m := <-hub.broadcast; m.event != "PURGE" {
+		t.Errorf("expected a PURGE event, got %+v", m)
+	}
+
+	found := false
+	for _, e := range mutes.list() {
+		if e.Userid == uid && e.Nick == "modtarget" {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("the mute should be listed")
+	}
+
+	if err := modUnmute(mod, "nosuchnick"); err != errNotFound {
+		t.Errorf("unmuting an unknown nick should fail, got %v", err)
+	}
+	if err := modUnmute(mod, "modtarget"); err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	if m := <-hub.broadcast; m.event != "UNMUTE" {
+		t.Errorf("expected an UNMUTE event, got %+v", m)
+	}
+}
+
+func TestModSubonly(t *testing.T) {
+	mod := &User{id: 61, nick: "moderator"}
+	if err := modSubonly(mod, "maybe"); err != errProtocol {
+		t.Errorf("expected a protocol error, got %v", err)
+	}
+}
+
+func TestAllowWrite(t *testing.T) {
+	newRequest := func(contenttype string, origin string) *http.Request {
+		r := httptest.NewRequest("POST", "http://chat.example.com/api/chat/admin/bans", strings.NewReader(`{}`))
+		if contenttype != "" {
+			r.Header.Set("Content-Type", contenttype)
+		}
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		return r
+	}
+
+	cases := []struct {
+		contenttype string
+		origin      string
+		allowed     bool
+	}{
+		{"application/json", "", true},
+		{"application/json; charset=utf-8", "http://chat.example.com", true},
+		{"", "", false},
+		{"application/x-www-form-urlencoded", "", false},
+		{"text/plain", "http://chat.example.com", false},
+		{"application/json", "http://evil.example.com", false},
+	}
+	for _, c := range cases {
+		if allowed := allowWrite(httptest.NewRecorder(), newRequest(c.contenttype, c.origin)); allowed != c.allowed {
+			t.Errorf("content type %q and origin %q: expected %v, got %v", c.contenttype, c.origin, c.allowed, allowed)
+		}
+	}
+}
@@ -8,24 +8,89 @@ type Mutes int
 
 var mutes Mutes
 
-func (m *Mutes) clean() {
+// loadActive fills the state.mutes cache from the database, the legacy mutes
+// from an old states file are written to the database too, the ones that
+// could not be stay in the states file to be migrated on the next start
+func (m *Mutes) loadActive(legacy map[Userid]time.Time) {
 	state.Lock()
 	defer state.Unlock()
 
-	for uid, unmutetime := range state.mutes {
-		if isExpiredUTC(unmutetime) {
-			delete(state.mutes, uid)
+	active := make(map[Userid]time.Time)
+	db.getMutes(func(uid Userid, endtime time.Time) {
+		active[uid] = endtime
+	})
+
+	now := time.Now().UTC()
+	pending := make(map[Userid]time.Time)
+	for uid, endtime := range legacy {
+		if _, ok := active[uid]; ok || isExpiredUTC(endtime) {
+			continue
+		}
+		D("Migrating mute from the states file", uid, endtime)
+		if err := db.migrateMute(uid, now, endtime); err != nil {
+			pending[uid] = endtime
 		}
+		active[uid] = endtime
+	}
+
+	state.mutes = active
+	if len(legacy) > 0 {
+		state.legacymutes = pending
+		state.save()
+	}
+	for uid, endtime := range active {
+		expirations.schedule(EXPIREMUTE, uid, endtime)
 	}
-	state.save()
 }
 
-func (m *Mutes) muteUserid(uid Userid, duration int64) {
+// MuteEntry is an active mute as listed by the admin api
+type MuteEntry struct {
+	Userid          Userid `json:"userid"`
+	Nick            string `json:"nick,omitempty"`
+	Expiretimestamp int64  `json:"expiretimestamp"` // unix milliseconds
+}
+
+// list returns the active mutes
+func (m *Mutes) list() []*MuteEntry {
+	entries := []*MuteEntry{}
+
+	state.RLock()
+	for uid, t := range state.mutes {
+		if !isExpiredUTC(t) {
+			entries = append(entries, &MuteEntry{Userid: uid, Expiretimestamp: t.UnixNano() / int64(time.Millisecond)})
+		}
+	}
+	state.RUnlock()
+
+	for _, e := range entries {
+		e.Nick, _ = db.getNick(e.Userid)
+	}
+	return entries
+}
+
+func (m *Mutes) muteUserid(uid Userid, targetuid Userid, duration int64, reason string) {
 	state.Lock()
 	defer state.Unlock()
 
-	state.mutes[uid] = time.Now().UTC().Add(time.Duration(duration))
-	state.save()
+	now := time.Now().UTC()
+	t := now.Add(time.Duration(duration))
+	state.mutes[targetuid] = t
+	db.insertMute(uid, targetuid, reason, now, t)
+	expirations.schedule(EXPIREMUTE, targetuid, t)
+}
+
+// expireUserid removes the mute if it still ends at the given time,
+// returns false if it was lifted or changed since
+func (m *Mutes) expireUserid(uid Userid, at time.Time) bool {
+	state.Lock()
+	defer state.Unlock()
+
+	if t, ok := state.mutes[uid]; !ok || !t.Equal(at) {
+		return false
+	}
+
+	delete(state.mutes, uid)
+	return true
 }
 
 func (m *Mutes) unmuteUserid(uid Userid) {
@@ -33,7 +98,7 @@ func (m *Mutes) unmuteUserid(uid Userid) {
 	defer state.Unlock()
 
 	delete(state.mutes, uid)
-	state.save()
+	db.deleteMute(uid)
 }
 
 func (m *Mutes) isUserMuted(c *Connection) bool {
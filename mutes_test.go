@@ -22,8 +22,50 @@ func TestMuteTimes(t *testing.T) {
 		t.Error("user should NOT be banned because the expiretime is in the past")
 	}
 
-	mutes.clean()
-	if len(state.mutes) > 0 {
-		t.Error("mutes.clean did not clean the users")
+	delete(state.mutes, uid)
+}
+
+func TestMutesPersist(t *testing.T) {
+	uid := Userid(41)
+	legacyuid := Userid(42)
+	timeinfuture := time.Now().UTC().Add(time.Hour).Truncate(time.Second)
+
+	mutes.muteUserid(1, uid, int64(time.Hour), "being rude")
+	mutes.loadActive(map[Userid]time.Time{legacyuid: timeinfuture})
+
+	// the insert of the mute is done asynchronously, the migration is not
+	for i := 0; i < 100; i++ {
+		mutes.loadActive(nil)
+		if _, ok := state.mutes[uid]; ok {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, ok := state.mutes[uid]; !ok {
+		t.Fatal("mute should be loaded back from the database")
+	}
+	if !state.mutes[legacyuid].Equal(timeinfuture) {
+		t.Error("mute from the states file should be migrated")
+	}
+	if len(state.legacymutes) != 0 {
+		t.Error("migrated mutes should not be kept in the states file")
+	}
+
+	mutes.unmuteUserid(uid)
+	mutes.unmuteUserid(legacyuid)
+	ended := func() bool {
+		_, muted := state.mutes[uid]
+		_, legacymuted := state.mutes[legacyuid]
+		return !muted && !legacymuted
+	}
+	for i := 0; i < 100; i++ {
+		mutes.loadActive(nil)
+		if ended() {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !ended() {
+		t.Errorf("mutes should have ended, got %v", state.mutes)
 	}
 }
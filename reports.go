@@ -0,0 +1,99 @@
+package main
+
+import (
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// a user can report once per REPORTINTERVAL
+const REPORTINTERVAL = 30 * time.Second
+
+type ReportIn struct {
+	Messageid int64  `json:"messageid"`
+	Nick      string `json:"nick"`
+	Reason    string `json:"reason"`
+}
+
+type Report struct {
+	Id         int64  `json:"id"`
+	Nick       string `json:"nick"`
+	Targetnick string `json:"targetnick"`
+	Messageid  int64  `json:"messageid,omitempty"`
+	Message    string `json:"message,omitempty"`
+	Reason     string `json:"reason"`
+	Timestamp  int64  `json:"timestamp"`
+	userid     Userid
+	targetuid  Userid
+}
+
+// getReportedMessage returns the author and text of a chat message in the history,
+// the messages table holds the same events as the cache
+func getReportedMessage(id int64) (nick string, msg string, ok bool) {
+	e := getCachedEvent(id)
+	if e == nil || e.event != "MSG" {
+		return "", "", false
+	}
+
+	out := &EventDataOut{}
+	if err := Unmarshal(e.data, out); err != nil {
+		return "", "", false
+	}
+	return e.nick, out.Data, true
+}
+
+func (c *Connection) OnReport(data []byte) {
+	in := &ReportIn{}
+	if err := Unmarshal(data, in); err != nil {
+		c.SendError("protocolerror")
+		return
+	}
+
+	if c.user == nil {
+		c.SendError("needlogin")
+		return
+	}
+
+	reason := strings.TrimSpace(in.Reason)
+	reasonlen := utf8.RuneCountInString(reason)
+	if !utf8.ValidString(reason) || reasonlen == 0 || reasonlen > 512 {
+		c.SendError("needreportreason")
+		return
+	}
+
+	r := &Report{
+		Nick:      c.user.nick,
+		Reason:    reason,
+		Timestamp: unixMilliTime(),
+		userid:    c.user.id,
+	}
+	if in.Messageid > 0 {
+		nick, msg, ok := getReportedMessage(in.Messageid)
+		if !ok {
+			c.SendError("notfound")
+			return
+		}
+		r.Targetnick, r.Messageid, r.Message = nick, in.Messageid, msg
+	} else {
+		r.Targetnick = in.Nick
+	}
+
+	r.targetuid, _ = usertools.getUseridForNick(r.Targetnick)
+	if r.targetuid == 0 || r.targetuid == c.user.id {
+		c.SendError("notfound")
+		return
+	}
+
+	if time.Since(c.user.lastreporttime) < REPORTINTERVAL {
+		c.SendError("throttled")
+		return
+	}
+	c.user.lastreporttime = time.Now()
+
+	if err := db.insertReport(r); err != nil {
+		c.SendError("protocolerror")
+		return
+	}
+
+	hub.emitToModerators("REPORT", r)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestReports(t *testing.T) {
+	db.newUser("reports-test-uuid", "reportednick", "10.0.0.1")
+	for len(hub.modmsg) > 0 {
+		<-hub.modmsg
+	}
+
+	c := &Connection{blocksend: make(chan *message, 4)}
+	c.user = &User{id: 99999, nick: "reporter"}
+
+	c.OnReport([]byte(`{"nick":"reportednick","reason":""}`))
+	if e := <-c.blocksend; e.data != "needreportreason" {
+		t.Errorf("report without reason should be rejected, got %+v", e)
+	}
+
+	c.OnReport([]byte(`{"nick":"reportednick","reason":"being rude"}`))
+	if len(hub.modmsg) != 1 {
+		t.Fatal("moderators should get the report")
+	}
+	if m := <-hub.modmsg; m.event != "REPORT" {
+		t.Errorf("expected a REPORT event, got %+v", m)
+	}
+
+	c.OnReport([]byte(`{"nick":"reportednick","reason":"still rude"}`))
+	if e := <-c.blocksend; e.data != "throttled" {
+		t.Errorf("second report should be throttled, got %+v", e)
+	}
+
+	reports := []*Report{}
+	db.getOpenReports(func(r *Report) {
+		reports = append(reports, r)
+	})
+	if len(reports) != 1 || reports[0].Targetnick != "reportednick" || reports[0].Reason != "being rude" {
+		t.Fatalf("expected the report to be stored, got %+v", reports)
+	}
+
+	if ok, _ := db.resolveReport(reports[0].Id, 1); !ok {
+		t.Error("unable to resolve report")
+	}
+	if ok, _ := db.resolveReport(reports[0].Id, 1); ok {
+		t.Error("report should only be resolved once")
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"sync"
+)
+
+// Shadowbans are users whose messages are only sent back to themselves
+type Shadowbans struct {
+	users map[Userid]bool
+	sync.RWMutex
+}
+
+var shadowbans = Shadowbans{users: make(map[Userid]bool)}
+
+func (s *Shadowbans) loadActive() {
+	users := make(map[Userid]bool)
+	db.getShadowbans(func(uid Userid) {
+		users[uid] = true
+	})
+
+	s.Lock()
+	defer s.Unlock()
+	s.users = users
+}
+
+func (s *Shadowbans) shadowbanUser(uid Userid, targetuid Userid) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.users[targetuid] {
+		return
+	}
+	s.users[targetuid] = true
+	db.insertShadowban(uid, targetuid)
+}
+
+func (s *Shadowbans) unshadowbanUser(targetuid Userid) {
+	s.Lock()
+	defer s.Unlock()
+
+	delete(s.users, targetuid)
+	db.deleteShadowban(targetuid)
+}
+
+func (s *Shadowbans) isShadowbanned(uid Userid) bool {
+	s.RLock()
+	defer s.RUnlock()
+	return s.users[uid]
+}
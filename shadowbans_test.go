@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestShadowbanPersists(t *testing.T) {
+	uid := Userid(31337)
+	shadowbans.shadowbanUser(1, uid)
+	if !shadowbans.isShadowbanned(uid) {
+		t.Fatal("user should be shadowbanned")
+	}
+
+	shadowbans.loadActive()
+	if !shadowbans.isShadowbanned(uid) {
+		t.Fatal("shadowban should be loaded back from the database")
+	}
+
+	shadowbans.unshadowbanUser(uid)
+	shadowbans.loadActive()
+	if shadowbans.isShadowbanned(uid) {
+		t.Fatal("shadowban should have ended")
+	}
+}
+
+func TestShadowbannedMessageIsEchoed(t *testing.T) {
+	for len(hub.broadcast) > 0 {
+		<-hub.broadcast
+	}
+
+	c := &Connection{blocksend: make(chan *message, 4)}
+	c.user = &User{id: 31338, nick: "shadowed"}
+	c.Echo("MSG", &EventDataOut{Data: "hello"})
+
+	if len(hub.broadcast) != 1 {
+		t.Fatal("message should be sent back to the user")
+	}
+	if m := <-hub.broadcast; m.userid != c.user.id || m.id == 0 {
+		t.Errorf("expected a message targeted at the user with an id, got %+v", m)
+	}
+}
+
+func TestShadowbannedMessageSkipsModeration(t *testing.T) {
+	for len(hub.broadcast) > 0 {
+		<-hub.broadcast
+	}
+	for len(hub.modmsg) > 0 {
+		<-hub.modmsg
+	}
+
+	uid := Userid(31339)
+	shadowbans.shadowbanUser(1, uid)
+	defer shadowbans.unshadowbanUser(uid)
+
+	filter := &Filter{Pattern: "heldword", Action: FILTERHOLD}
+	if err := filters.add(1, filter); err != nil {
+		t.Fatal(err)
+	}
+	defer filters.remove(filter.Id)
+	heldbefore := len(held.list())
+
+	c := &Connection{blocksend: make(chan *message, 4)}
+	c.user = &User{id: uid, nick: "shadowheld"}
+	c.user.assembleSimplifiedUser()
+	c.OnMsg([]byte(`{"data":"a heldword message"}`))
+
+	if len(hub.broadcast) != 1 {
+		t.Fatal("the message should only be echoed back to the user")
+	}
+	if m := <-hub.broadcast; m.userid != uid {
+		t.Error("the message should only be echoed back to the user")
+	}
+	if len(hub.modmsg) != 0 || len(held.list()) != heldbefore {
+		t.Error("a shadowbanned message should never be held for the moderators")
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/md5"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// messages shorter than this after normalizing are never part of a spam wave
+const SPAMMINLENGTH = 10
+
+type spamEntry struct {
+	at   time.Time
+	sum  [md5.Size]byte
+	uid  Userid
+	nick string
+}
+
+// SpamWaves detects the same text being posted by many accounts in a short time
+type SpamWaves struct {
+	entries   []*spamEntry // oldest first
+	triggered map[[md5.Size]byte]time.Time
+	sync.Mutex
+}
+
+type SpamWaveOut struct {
+	Message   string   `json:"data"`
+	Nicks     []string `json:"nicks"`
+	Timestamp int64    `json:"timestamp"`
+}
+
+var spamwaves = SpamWaves{triggered: make(map[[md5.Size]byte]time.Time)}
+
+// normalizeSpam returns the text of the message without emotes, nicks, links,
+// case, punctuation and whitespace, so small variations still match
+func normalizeSpam(msg string, e *Entities) string {
+	var b strings.Builder
+	for _, r := range automodPlainText(msg, e) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(unicode.ToLower(r))
+		}
+	}
+	return b.String()
+}
+
+// check returns false if the message is part of a spam wave, the participants
+// are muted and the moderators are notified
+func (s *SpamWaves) check(c *Connection, msg string, e *Entities) bool {
+	if SPAMTHRESHOLD <= 0 || c.user.isExempt() {
+		return true
+	}
+
+	normalized := normalizeSpam(msg, e)
+	if len([]rune(normalized)) < SPAMMINLENGTH {
+		return true
+	}
+	sum := md5.Sum([]byte(normalized))
+
+	s.Lock()
+	now := time.Now()
+	s.prune(now)
+
+	// once a wave is detected anybody joining in is muted right away
+	if _, ok := s.triggered[sum]; ok {
+		s.Unlock()
+		c.autoMute(int64(DEFAULTMUTEDURATION), "spam wave")
+		return false
+	}
+
+	s.entries = append(s.entries, &spamEntry{now, sum, c.user.id, c.user.nick})
+
+	participants := map[Userid]string{}
+	for _, entry := range s.entries {
+		if entry.sum == sum {
+			participants[entry.uid] = entry.nick
+		}
+	}
+	if len(participants) < SPAMTHRESHOLD {
+		s.Unlock()
+		return true
+	}
+	s.triggered[sum] = now
+	s.Unlock()
+
+	D("Spam wave detected", msg, participants)
+	nicks := make([]string, 0, len(participants))
+	for uid, nick := range participants {
+		nicks = append(nicks, nick)
+		if uid == c.user.id {
+			continue
+		}
+		mutes.muteUserid(0, uid, int64(DEFAULTMUTEDURATION), "spam wave")
+		audit(0, "MUTE", uid, nick, map[string]int64{"duration": int64(DEFAULTMUTEDURATION)}, "spam wave")
+		broadcastFrom(nil, "MUTE", &EventDataOut{
+			Targetuserid: uid,
+			Timestamp:    unixMilliTime(),
+			Data:         nick,
+		})
+	}
+	c.autoMute(int64(DEFAULTMUTEDURATION), "spam wave")
+
+	hub.emitToModerators("SPAMWAVE", &SpamWaveOut{
+		Message:   msg,
+		Nicks:     nicks,
+		Timestamp: unixMilliTime(),
+	})
+	return false
+}
+
+// prune drops everything older than the window, expects the lock to be held
+func (s *SpamWaves) prune(now time.Time) {
+	i := 0
+	for i < len(s.entries) && now.Sub(s.entries[i].at) > SPAMWINDOW {
+		i++
+	}
+	s.entries = s.entries[i:]
+
+	for sum, at := range s.triggered {
+		if now.Sub(at) > SPAMWINDOW {
+			delete(s.triggered, sum)
+		}
+	}
+}
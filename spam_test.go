@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSpamWaves(t *testing.T) {
+	SPAMTHRESHOLD = 3
+	defer func() {
+		SPAMTHRESHOLD = 5
+		for uid := Userid(100); uid <= 104; uid++ {
+			delete(state.mutes, uid)
+		}
+	}()
+
+	if n := normalizeSpam("Buy CHEAP followers, now!!", &Entities{}); n != "buycheapfollowersnow" {
+		t.Error("unexpected normalized message", n)
+	}
+
+	newConnection := func(uid Userid) *Connection {
+		c := &Connection{blocksend: make(chan *message, 4)}
+		c.user = &User{id: uid, nick: "spammer"}
+		return c
+	}
+
+	if !spamwaves.check(newConnection(100), "buy cheap followers now", &Entities{}) {
+		t.Error("first post should not be a spam wave")
+	}
+	if !spamwaves.check(newConnection(100), "buy cheap followers now", &Entities{}) {
+		t.Error("the same account posting twice should not be a spam wave")
+	}
+	if !spamwaves.check(newConnection(101), "Buy cheap followers now!", &Entities{}) {
+		t.Error("two accounts should not be a spam wave")
+	}
+	if spamwaves.check(newConnection(102), "buy CHEAP followers now", &Entities{}) {
+		t.Error("three accounts should be a spam wave")
+	}
+	if spamwaves.check(newConnection(103), "buy cheap followers now", &Entities{}) {
+		t.Error("joining a detected spam wave should be stopped right away")
+	}
+	if !spamwaves.check(newConnection(104), "lol", &Entities{}) {
+		t.Error("short messages should never be a spam wave")
+	}
+}
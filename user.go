@@ -77,9 +77,12 @@ type Userid int32
 type User struct {
 	id              Userid
 	nick            string
+	firstlogin      time.Time
 	features        uint32
-	lastmessage     []byte // TODO remove?
+	lastmessages    []string // normalized, oldest first, see isDuplicate
 	lastmessagetime time.Time
+	lastchattime    time.Time // last MSG, privmsgs do not count for slowmode
+	lastreporttime  time.Time
 	delayscale      uint8
 	simplified      *SimplifiedUser
 	connections     int32
@@ -178,7 +181,7 @@ func userfromCookie(cookie string, ip string) (u *User, err error) {
 
 	// now get features from db, update stuff - TODO
 
-	features, uid, err := db.getUserInfo(claims.UserId)
+	features, uid, firstlogin, err := db.getUserInfo(claims.UserId)
 	if err != nil {
 		fmt.Println("err4", err)
 		return nil, err
@@ -186,12 +189,14 @@ func userfromCookie(cookie string, ip string) (u *User, err error) {
 
 	// finally update records...
 	db.updateUser(Userid(uid), username, ip)
+	db.insertUserIP(Userid(uid), ip)
 
 	u = &User{
 		id:              Userid(uid),
 		nick:            username,
+		firstlogin:      firstlogin,
 		features:        0,
-		lastmessage:     nil,
+		lastmessages:    nil,
 		lastmessagetime: time.Time{},
 		delayscale:      1,
 		simplified:      nil,
@@ -239,6 +244,11 @@ func (u *User) isSubscriber() bool {
 	return u.featureGet(ISSUBSCRIBER | ISADMIN | ISMODERATOR | ISVIP | ISBOT)
 }
 
+// isExempt checks if the user is not affected by chat modes like slowmode
+func (u *User) isExempt() bool {
+	return u.featureGet(ISADMIN | ISMODERATOR | ISVIP | ISBOT)
+}
+
 // isBot checks if the user is exempt from ratelimiting
 func (u *User) isBot() bool {
 	return u.featureGet(ISBOT)
@@ -326,17 +336,21 @@ func (u *User) assembleSimplifiedUser() {
 	}
 }
 
-func getUserFromWebRequest(r *http.Request) (user *User, banned bool, ip string) {
+func getIPFromWebRequest(r *http.Request) string {
 	// TODO make this an option? - need this if run behind e.g. nginx
 	// TODO test
-	ip = r.Header.Get("X-Forwarded-For")
+	ip := r.Header.Get("X-Forwarded-For")
 	if ip == "" {
 		ip, _, _ = net.SplitHostPort(r.RemoteAddr)
 	}
 
-	ip = getMaskedIP(ip)
-	banned = bans.isIPBanned(ip)
-	if banned {
+	return getMaskedIP(ip)
+}
+
+func getUserFromWebRequest(r *http.Request) (user *User, ban *BanInfo, ip string) {
+	ip = getIPFromWebRequest(r)
+	ban = bans.getBanInfo(0, ip)
+	if ban != nil {
 		return
 	}
 
@@ -351,8 +365,8 @@ func getUserFromWebRequest(r *http.Request) (user *User, banned bool, ip string)
 		return
 	}
 
-	banned = bans.isUseridBanned(user.id)
-	if banned {
+	ban = bans.getBanInfo(user.id, "")
+	if ban != nil {
 		return
 	}
 